@@ -0,0 +1,300 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+
+	"pukcab/tar"
+)
+
+// Usage is the size of a file or directory
+type Usage struct {
+	Path    string
+	Size    int64
+	Dir     bool
+	Percent float32
+}
+
+// Analysis records the size of all files and directories of a backup set
+type Analysis struct {
+	Date   BackupID
+	Name   string
+	Unique bool
+	Total  int64
+	Files  map[string]int64
+	Dirs   map[string]int64
+}
+
+// analyse computes the size of each file of a backup set and the cumulative size of each directory
+// from the metadata stream (when unique is set, files whose contents already are in the previous
+// backup are ignored)
+func analyse(name string, date BackupID, unique bool) (*Analysis, error) {
+	a := &Analysis{
+		Unique: unique,
+		Files:  make(map[string]int64),
+		Dirs:   make(map[string]int64),
+	}
+	hashes := make(map[string]string)
+
+	if err := process("metadata", &Backup{Name: name, Date: date}, func(hdr tar.Header) {
+		switch hdr.Typeflag {
+		case tar.TypeXGlobalHeader:
+			a.Date, a.Name = BackupID(hdr.ModTime.Unix()), hdr.Name
+		case tar.TypeReg:
+			p := path.Join("/", hdr.Name)
+			a.Files[p] = hdr.Size
+			hashes[p] = hdr.Xattrs["backup.hash"]
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	previous := make(map[string]struct{})
+	if unique && a.Date > 1 {
+		if err := process("metadata", &Backup{Name: a.Name, Date: a.Date - 1}, func(hdr tar.Header) {
+			if hdr.Typeflag == tar.TypeReg && hdr.Xattrs["backup.hash"] != "" {
+				previous[hdr.Xattrs["backup.hash"]] = struct{}{}
+			}
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	for p, size := range a.Files {
+		if _, ok := previous[hashes[p]]; ok {
+			delete(a.Files, p)
+			continue
+		}
+		a.Total += size
+		for d := path.Dir(p); ; d = path.Dir(d) {
+			a.Dirs[d] += size
+			if d == "/" {
+				break
+			}
+		}
+	}
+
+	return a, nil
+}
+
+func (a *Analysis) usage(list []Usage, total int64) []Usage {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Size != list[j].Size {
+			return list[i].Size > list[j].Size
+		}
+		return list[i].Path < list[j].Path
+	})
+	for i := range list {
+		if total > 0 {
+			list[i].Percent = 100 * float32(list[i].Size) / float32(total)
+		}
+	}
+	return list
+}
+
+// Top returns the n biggest files (or directories)
+func (a *Analysis) Top(n int, dirs bool) []Usage {
+	list := []Usage{}
+	if dirs {
+		for p, size := range a.Dirs {
+			if p != "/" {
+				list = append(list, Usage{Path: p, Size: size, Dir: true})
+			}
+		}
+	} else {
+		for p, size := range a.Files {
+			list = append(list, Usage{Path: p, Size: size})
+		}
+	}
+	list = a.usage(list, a.Total)
+	if n > 0 && len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// Children returns the files and directories directly inside a directory, biggest first
+func (a *Analysis) Children(dir string) []Usage {
+	list := []Usage{}
+	for p, size := range a.Dirs {
+		if p != dir && path.Dir(p) == dir {
+			list = append(list, Usage{Path: p, Size: size, Dir: true})
+		}
+	}
+	for p, size := range a.Files {
+		if path.Dir(p) == dir {
+			list = append(list, Usage{Path: p, Size: size})
+		}
+	}
+	return a.usage(list, a.Dirs[dir])
+}
+
+// Churn records how often a file changed over a range of backups
+type Churn struct {
+	Path    string
+	Changes int
+	Bytes   int64
+}
+
+// churn counts, for each file of a client, how many backups it changed in between two dates and
+// how many bytes these changes added to the vault
+func churn(name string, from, to BackupID) (list []Churn, backups int, err error) {
+	hashes := make(map[string]string)
+	changes := make(map[string]*Churn)
+	current := BackupID(0)
+
+	if err := process("timeline", &Backup{Name: name, Date: from}, func(hdr tar.Header) {
+		switch hdr.Typeflag {
+		case tar.TypeXGlobalHeader:
+			current = BackupID(hdr.ModTime.Unix())
+			if to == 0 || current <= to {
+				backups++
+			}
+		case tar.TypeReg:
+			if to != 0 && current > to {
+				return
+			}
+			p := path.Join("/", hdr.Name)
+			hash := hdr.Xattrs["backup.hash"]
+			previous, seen := hashes[p]
+			hashes[p] = hash
+			if !seen || previous == hash {
+				return
+			}
+			if changes[p] == nil {
+				changes[p] = &Churn{Path: p}
+			}
+			changes[p].Changes++
+			changes[p].Bytes += hdr.Size
+		}
+	}); err != nil {
+		return nil, 0, err
+	}
+
+	for _, c := range changes {
+		list = append(list, *c)
+	}
+	return list, backups, nil
+}
+
+// topchurn sorts files by number of changes (or by bytes) and returns the n first ones
+func topchurn(list []Churn, n int, bytes bool) []Churn {
+	sort.Slice(list, func(i, j int) bool {
+		if bytes && list[i].Bytes != list[j].Bytes {
+			return list[i].Bytes > list[j].Bytes
+		}
+		if list[i].Changes != list[j].Changes {
+			return list[i].Changes > list[j].Changes
+		}
+		if list[i].Bytes != list[j].Bytes {
+			return list[i].Bytes > list[j].Bytes
+		}
+		return list[i].Path < list[j].Path
+	})
+	if n > 0 && len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+func printchurn(list []Churn) {
+	for _, c := range list {
+		fmt.Printf("%5d %8s %s\n", c.Changes, Bytes(uint64(c.Bytes)), c.Path)
+	}
+}
+
+func churnanalysis(from, to BackupID, top int) {
+	list, backups, err := churn(name, from, to)
+	if err != nil {
+		failure.Println(err)
+		log.Fatal(err)
+	}
+	if backups == 0 {
+		failure.Fatal("Backup not found")
+	}
+
+	total := int64(0)
+	for _, c := range list {
+		total += c.Bytes
+	}
+
+	fmt.Println("Name:   ", name)
+	if from != 0 {
+		fmt.Println("From:   ", from)
+	}
+	if to != 0 {
+		fmt.Println("To:     ", to)
+	}
+	fmt.Println("Backups:", backups)
+	fmt.Println("Changed:", len(list))
+	fmt.Println("Size:   ", Bytes(uint64(total)))
+	fmt.Println()
+	fmt.Println("Most often changed files:")
+	printchurn(topchurn(list, top, false))
+	fmt.Println()
+	fmt.Println("Files adding the most data:")
+	printchurn(topchurn(list, top, true))
+}
+
+func printusage(list []Usage) {
+	for _, u := range list {
+		fmt.Printf("%8s %5.1f%% %s\n", Bytes(uint64(u.Size)), u.Percent, u.Path)
+	}
+}
+
+func analysis() {
+	top := 20
+	unique := false
+	churning := false
+	from, to := BackupID(0), BackupID(0)
+	date.Set("now")
+
+	flag.StringVar(&name, "name", defaultName, "Backup name")
+	flag.StringVar(&name, "n", defaultName, "-name")
+	flag.Var(&date, "date", "Backup set")
+	flag.Var(&date, "d", "-date")
+	flag.StringVar(&label, "label", "", "Backup label")
+	flag.IntVar(&top, "top", top, "Number of files and directories to display")
+	flag.BoolVar(&unique, "unique", unique, "Only count data which isn't in the previous backup")
+	flag.BoolVar(&unique, "u", unique, "-unique")
+	flag.BoolVar(&churning, "churn", churning, "Find the files which change most often")
+	flag.Var(&from, "from", "Start of the range of backups to analyse")
+	flag.Var(&to, "to", "End of the range of backups to analyse")
+
+	Setup()
+
+	if churning {
+		if name == "" {
+			failure.Fatal("Missing backup name")
+		}
+		churnanalysis(from, to, top)
+		return
+	}
+
+	if label != "" {
+		date = labelled(name, label)
+	}
+
+	a, err := analyse(name, date, unique)
+	if err != nil {
+		failure.Println(err)
+		log.Fatal(err)
+	}
+	if a.Date == 0 {
+		failure.Fatal("Backup not found")
+	}
+
+	fmt.Println("Date: ", a.Date)
+	fmt.Println("Name: ", a.Name)
+	fmt.Println("Files:", len(a.Files))
+	fmt.Println("Size: ", Bytes(uint64(a.Total)))
+	fmt.Println()
+	fmt.Println("Biggest files:")
+	printusage(a.Top(top, false))
+	fmt.Println()
+	fmt.Println("Biggest directories:")
+	printusage(a.Top(top, true))
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// trailers of the responses to POST /api/COMMAND (the request body is the command's standard input,
+// the response body its standard output)
+const exitTrailer = "Pukcab-Exit"   // exit status
+const errorTrailer = "Pukcab-Error" // standard error (one trailer per line)
+
+// ishttp checks whether the server is reached through HTTP(S) (plain HTTP is refused by newhttpcommand)
+func ishttp() bool {
+	return strings.HasPrefix(cfg.Server, "https://") || strings.HasPrefix(cfg.Server, "http://")
+}
+
+// apienabled checks whether authenticated clients are configured
+func apienabled() bool {
+	return len(cfg.Tokens) > 0 || cfg.CA != ""
+}
+
+func loadCA() (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(cfg.CA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("No certificate found in " + cfg.CA)
+	}
+	return pool, nil
+}
+
+// tlsconfig returns the TLS configuration of the web interface (server) or of the HTTPS transport (client)
+func tlsconfig() (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if cfg.Certificate != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Certificate, cfg.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.CA != "" {
+		pool, err := loadCA()
+		if err != nil {
+			return nil, err
+		}
+		if cfg.IsServer() {
+			config.ClientCAs = pool
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		} else {
+			config.RootCAs = pool
+		}
+	}
+
+	return config, nil
+}
+
+// apiclient authenticates an API request (returns the client name)
+func apiclient(r *http.Request) (string, error) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		for client, t := range cfg.Tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				return client, nil
+			}
+		}
+		return "", errors.New("Invalid token")
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		if client := r.TLS.VerifiedChains[0][0].Subject.CommonName; client != "" {
+			return client, nil
+		}
+	}
+	return "", errors.New("Missing credentials")
+}
+
+// lineWriter sends each line written to it as an HTTP trailer
+type lineWriter struct {
+	header http.Header
+	line   []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.line = append(l.line, p...)
+	for {
+		i := strings.IndexByte(string(l.line), '\n')
+		if i < 0 {
+			break
+		}
+		l.header.Add(errorTrailer, string(l.line[:i]))
+		l.line = l.line[i+1:]
+	}
+	return len(p), nil
+}
+
+// flushWriter sends data to the client as soon as it's available
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+func webapi(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	client, err := apiclient(r)
+	if err != nil {
+		log.Printf("Denied API request: ip=%q msg=%q error=warn\n", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	args := append([]string{strings.TrimPrefix(r.URL.Path, "/api/")}, r.URL.Query()["arg"]...)
+	if args[0] == "session" {
+		err = errors.New("Sessions are not available over HTTP")
+	} else {
+		args, err = restrict(client, args)
+	}
+	if err != nil {
+		log.Printf("Denied command: client=%q command=%q msg=%q error=warn\n", client, r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	log.Printf("Allowed command: client=%q ip=%q command=%q\n", client, r.RemoteAddr, strings.Join(args, " "))
+
+	http.NewResponseController(w).EnableFullDuplex()
+
+	stderr := &lineWriter{header: w.Header()}
+	cmd := exec.Command(programFile, args...)
+	cmd.Stdin = r.Body
+	cmd.Stdout = &flushWriter{w}
+	cmd.Stderr = stderr
+
+	w.Header().Set("Trailer", exitTrailer+", "+errorTrailer)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+
+	status := 0
+	if err := cmd.Run(); err != nil {
+		if status = exitstatus(err); status < 0 {
+			log.Println(args, err)
+			stderr.Write([]byte(JSON(ErrorFrame{Error: err.Error(), Command: args[0]})))
+			status = 1
+		}
+	}
+	if len(stderr.line) > 0 {
+		stderr.Write([]byte("\n"))
+	}
+	w.Header().Set(exitTrailer, strconv.Itoa(status))
+}
+
+// HTTPCommand is a server command run through the HTTP(S) transport
+type HTTPCommand struct {
+	url    string
+	stdin  io.Reader
+	stdout *io.PipeWriter
+	done   chan struct{}
+	status int
+	err    error
+}
+
+var httpclient *http.Client
+
+func newhttpcommand(args []string) (*HTTPCommand, error) {
+	if !strings.HasPrefix(cfg.Server, "https://") { // never send credentials in cleartext
+		return nil, errors.New("The HTTP transport requires HTTPS: " + cfg.Server)
+	}
+	if httpclient == nil {
+		config, err := tlsconfig()
+		if err != nil {
+			return nil, err
+		}
+		httpclient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: config,
+			},
+		}
+	}
+
+	query := url.Values{}
+	for _, arg := range args[1:] {
+		query.Add("arg", arg)
+	}
+	return &HTTPCommand{
+		url:  strings.TrimRight(cfg.Server, "/") + "/api/" + url.PathEscape(args[0]) + "?" + query.Encode(),
+		done: make(chan struct{}),
+	}, nil
+}
+
+// StdinPipe returns a pipe connected to the command's standard input
+func (h *HTTPCommand) StdinPipe() (io.WriteCloser, error) {
+	r, w := io.Pipe()
+	h.stdin = r
+	return w, nil
+}
+
+// StdoutPipe returns a pipe connected to the command's standard output (the response is only read as fast as the pipe is)
+func (h *HTTPCommand) StdoutPipe() (io.ReadCloser, error) {
+	r, w := io.Pipe()
+	h.stdout = w
+	return r, nil
+}
+
+// Start sends the request to the server
+func (h *HTTPCommand) Start(stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	if h.stdin == nil {
+		h.stdin = stdin
+	}
+	body := h.stdin
+	if body == nil {
+		body = http.NoBody
+	}
+
+	req, err := http.NewRequest("POST", h.url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Token)
+	}
+
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+
+	go func() {
+		defer close(h.done)
+
+		resp, err := httpclient.Do(req)
+		if err != nil {
+			h.fail(err)
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+			h.fail(fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg))))
+			return
+		}
+
+		var out io.Writer = ioutil.Discard
+		if h.stdout != nil {
+			out = h.stdout
+		} else if stdout != nil {
+			out = stdout
+		}
+		if _, err := io.Copy(out, resp.Body); err != nil {
+			h.fail(err)
+			return
+		}
+
+		for _, line := range resp.Trailer[errorTrailer] {
+			fmt.Fprintln(stderr, line)
+		}
+		if status, err := strconv.Atoi(resp.Trailer.Get(exitTrailer)); err == nil {
+			h.status = status
+		} else {
+			h.fail(errors.New("Incomplete response from server"))
+			return
+		}
+		if h.stdout != nil {
+			h.stdout.Close()
+		}
+	}()
+
+	return nil
+}
+
+func (h *HTTPCommand) fail(err error) {
+	h.err = err
+	if h.stdout != nil {
+		h.stdout.CloseWithError(err)
+	}
+}
+
+// Wait waits for the command to complete
+func (h *HTTPCommand) Wait() error {
+	<-h.done
+	if h.err != nil {
+		return h.err
+	}
+	if h.status != 0 {
+		return &ExitError{Code: h.status}
+	}
+	return nil
+}
+
+// serveapi starts the HTTP transport on its own listener (on servers with authenticated clients, over TLS only),
+// so that clients never reach the web interface
+func serveapi() error {
+	if !cfg.IsServer() || !apienabled() || cfg.API == "" {
+		return nil
+	}
+	if cfg.Certificate == "" {
+		log.Println("HTTP transport disabled: msg=\"no certificate configured\" error=warn")
+		return nil
+	}
+
+	config, err := tlsconfig()
+	if err != nil {
+		return err
+	}
+	listener, err := tls.Listen("tcp", cfg.API, config)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/", webapi)
+	go http.Serve(listener, mux)
+	log.Println("Started HTTP transport on", cfg.API)
+	return nil
+}
+
+// listenandserve starts the web interface (using TLS if a certificate is configured)
+func listenandserve(listen string) error {
+	if cfg.Certificate == "" {
+		return http.ListenAndServe(listen, nil)
+	}
+
+	config, err := tlsconfig()
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Addr:      listen,
+		TLSConfig: config,
+	}
+	return server.ListenAndServeTLS("", "")
+}
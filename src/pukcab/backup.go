@@ -22,6 +22,9 @@ type Backup struct {
 	LastModified   time.Time
 	Files          int64
 	Size           int64
+	Pinned         bool
+	Label          string
+	Comment        string
 
 	backupset   map[string]struct{}
 	directories map[string]bool
@@ -257,6 +260,9 @@ func Check(hdr tar.Header, quick bool) (result Status) {
 		}
 
 		if hash, ok := hdr.Xattrs["backup.hash"]; ok {
+			if cached, ok := state.Lookup(hdr.Name, fhdr); ok && cached == hash {
+				return
+			}
 			if hash1, hash2 := Hash(hdr.Name); hash != hash1 && hash != hash2 {
 				result = Modified
 			}
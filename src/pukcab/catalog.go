@@ -20,6 +20,9 @@ const (
 var repository *git.Repository
 
 func opencatalog() error {
+	if repository != nil { // already opened by the session
+		return nil
+	}
 	if err := os.MkdirAll(cfg.Vault, 0700); err != nil {
 		return err
 	}
@@ -51,12 +54,15 @@ func reschedule(backup BackupID, name string, s string) (schedule string) {
 		return s
 	}
 
+	schedules := cfg.Schedules()
 	schedule = defaultSchedule
-	if schedule != "daily" { // only daily backups get re-scheduled
+	if schedule != schedules[0].Name { // only backups of the shortest schedule get re-scheduled
 		return
 	}
 
-	var earliest, firstweekly, firstmonthly, latest, lastweekly, lastmonthly, lastyearly BackupID
+	var earliest, latest BackupID
+	first := make(map[string]BackupID)
+	last := make(map[string]BackupID)
 
 	for _, b := range Backups(repository, name, "*") {
 		if earliest == 0 || b.Date < earliest {
@@ -65,26 +71,11 @@ func reschedule(backup BackupID, name string, s string) (schedule string) {
 		if b.Date > latest {
 			latest = b.Date
 		}
-
-		switch b.Schedule {
-		case "weekly":
-			if firstweekly == 0 || b.Date < firstweekly {
-				firstweekly = b.Date
-			}
-			if b.Date > lastweekly {
-				lastweekly = b.Date
-			}
-		case "monthly":
-			if firstmonthly == 0 || b.Date < firstmonthly {
-				firstmonthly = b.Date
-			}
-			if b.Date > lastmonthly {
-				lastmonthly = b.Date
-			}
-		case "yearly":
-			if b.Date > lastyearly {
-				lastyearly = b.Date
-			}
+		if first[b.Schedule] == 0 || b.Date < first[b.Schedule] {
+			first[b.Schedule] = b.Date
+		}
+		if b.Date > last[b.Schedule] {
+			last[b.Schedule] = b.Date
 		}
 	}
 
@@ -92,15 +83,24 @@ func reschedule(backup BackupID, name string, s string) (schedule string) {
 		return
 	}
 
-	today := midnight(backup)
-
-	switch {
-	case firstmonthly != 0 && min(today-firstmonthly, today-lastyearly) > 365*24*60*60:
-		return "yearly"
-	case firstweekly != 0 && min(today-firstweekly, today-lastmonthly) > 31*24*60*60:
-		return "monthly"
-	case earliest != 0 && min(today-earliest, today-lastweekly) > 7*24*60*60:
-		return "weekly"
+	// promote to the longest schedule whose interval has elapsed since its last backup,
+	// provided the next shorter schedule has been running for that long too
+	for i := len(schedules) - 1; i > 0; i-- {
+		since := earliest
+		if i > 1 {
+			since = first[schedules[i-1].Name]
+		}
+		if since == 0 {
+			continue
+		}
+		interval := BackupID(schedules[i].Duration() / time.Second)
+		today := backup
+		if schedules[i].Duration() >= 24*time.Hour {
+			today = midnight(backup)
+		}
+		if min(today-since, today-last[schedules[i].Name]) > interval {
+			return schedules[i].Name
+		}
 	}
 
 	return
@@ -147,3 +147,27 @@ func countfiles(repository *git.Repository, date BackupID) (files int64, missing
 	}
 	return
 }
+
+// storeddata returns the data blobs used by the backups of a client and their total size
+func storeddata(repository *git.Repository, name string) (blobs map[git.ID]bool, size int64) {
+	blobs = make(map[git.ID]bool)
+	for _, backup := range Backups(repository, name, "*") {
+		if ref := repository.Reference(backup.Date.String()); git.Valid(ref) {
+			if err := repository.Recurse(ref,
+				func(path string, node git.Node) error {
+					if strings.HasPrefix(path, DATAROOT+"/") && !blobs[node.ID()] {
+						if obj, err := repository.Object(node); err == nil {
+							if blob, ok := obj.(git.Blob); ok {
+								blobs[node.ID()] = true
+								size += int64(blob.Size())
+							}
+						}
+					}
+					return nil
+				}); err != nil {
+				LogExit(err)
+			}
+		}
+	}
+	return
+}
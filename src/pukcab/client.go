@@ -3,11 +3,12 @@ package main
 import (
 	"bufio"
 	"compress/gzip"
-	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
@@ -16,6 +17,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
 	"pukcab/tar"
 )
 
@@ -26,17 +30,33 @@ func backup() {
 	flag.StringVar(&schedule, "r", "", "-schedule")
 	flag.BoolVar(&full, "full", full, "Full backup")
 	flag.BoolVar(&full, "f", full, "-full")
+	flag.StringVar(&label, "label", "", "Backup label")
+	flag.StringVar(&comment, "comment", "", "Backup comment")
 	Setup()
 
 	if len(flag.Args()) != 0 {
 		failure.Fatal("Too many parameters: ", strings.Join(flag.Args(), " "))
 	}
 
-	if err := dobackup(name, schedule, full); err != nil {
+	if schedule == "" && profile != "" {
+		schedule = cfg.Profile[profile].Schedule
+	}
+
+	UseSession()
+	defer CloseSession()
+
+	switch err := dobackup(name, schedule, full); err {
+	case nil:
+	case errSkipped:
+		fmt.Println("Backup skipped.")
+		os.Exit(exitSkipped)
+	default:
 		failure.Fatal("Backup failure.")
 	}
 }
 
+var errSkipped = errors.New("Backup skipped")
+
 func dobackup(name string, schedule string, full bool) (fail error) {
 	info.Printf("Starting backup: name=%q schedule=%q\n", name, schedule)
 	log.Printf("Starting backup: name=%q schedule=%q\n", name, schedule)
@@ -52,6 +72,12 @@ func dobackup(name string, schedule string, full bool) (fail error) {
 	if force {
 		cmdline = append(cmdline, "-force")
 	}
+	if label != "" {
+		cmdline = append(cmdline, "-label", label)
+	}
+	if comment != "" {
+		cmdline = append(cmdline, "-comment", comment)
+	}
 
 	backup.Start(name, schedule)
 
@@ -84,34 +110,13 @@ func dobackup(name string, schedule string, full bool) (fail error) {
 
 	info.Println("done.")
 
-	var previous int64
-	scanner := bufio.NewScanner(stdout)
-	if scanner.Scan() {
-		if d, err := strconv.ParseInt(scanner.Text(), 10, 0); err != nil {
-			failure.Println("Protocol error")
-			log.Println("Protocol error")
-			return err
-		} else {
-			backup.Date = BackupID(d)
-		}
-	}
-
-	if backup.Date == 0 {
-		scanner.Scan()
-		errmsg := scanner.Text()
-		failure.Println("Server error", errmsg)
-		log.Println("Server error", errmsg)
-		return errors.New("Server error")
-	} else {
-		info.Printf("New backup: date=%d name=%q files=%d\n", backup.Date, backup.Name, backup.Count())
-		log.Printf("New backup: date=%d name=%q files=%d\n", backup.Date, backup.Name, backup.Count())
-		if scanner.Scan() {
-			previous, _ = strconv.ParseInt(scanner.Text(), 10, 0)
-			if previous > 0 {
-				info.Printf("Previous backup: date=%d\n", previous)
-				log.Printf("Previous backup: date=%d\n", previous)
-			}
+	previous, err := readnewbackup(backup, stdout)
+	if err != nil {
+		if status := exitstatus(cmd.Wait()); err == errSkipped || status == exitSkipped {
+			log.Printf("Skipped backup: name=%q\n", name)
+			return errSkipped
 		}
+		return err
 	}
 
 	if err := cmd.Wait(); err != nil {
@@ -122,9 +127,19 @@ func dobackup(name string, schedule string, full bool) (fail error) {
 
 	files := backup.Count()
 
+	state = LoadState(name)
+	cached := make(map[string]bool) // files skipped because of the state cache
 	if !full {
 		info.Print("Determining files to backup... ")
-		if err := checkmetadata(backup); err != nil {
+		if state.Valid(BackupID(previous)) {
+			debug.Println("Using state cache for backup", previous)
+			backup.ForEach(func(f string) {
+				if state.Unchanged(f) {
+					backup.Forget(f)
+					cached[f] = true
+				}
+			})
+		} else if err := checkmetadata(backup); err != nil {
 			return err
 		}
 		backuptype := "incremental"
@@ -136,9 +151,93 @@ func dobackup(name string, schedule string, full bool) (fail error) {
 		log.Printf("Backup: date=%d name=%q files=%d type=%s\n", backup.Date, backup.Name, backup.Count(), backuptype)
 	}
 
-	bytes := dumpfiles(files, backup)
+	bytes, complete := dumpfiles(files, backup)
 	log.Printf("Finished sending: date=%d name=%q schedule=%q files=%d sent=%d duration=%.0f\n", backup.Date, name, schedule, backup.Count(), bytes, time.Since(backup.Started).Seconds())
 
+	switch {
+	case complete:
+		if err := state.Commit(backup.Date); err != nil {
+			log.Println("Could not save state cache:", err)
+		}
+	case len(cached) > 0 && outofsync(backup, cached): // the server didn't have what the cache told us
+		info.Println("State cache out of sync.")
+		log.Printf("State cache out of sync: date=%d name=%q previous=%d\n", backup.Date, name, previous)
+		state.Invalidate()
+		return doresume(backup.Date, name)
+	}
+
+	return
+}
+
+// outofsync checks whether the server is still missing files the state cache told us it already had
+func outofsync(backup *Backup, cached map[string]bool) bool {
+	stale := false
+	if err := process("metadata", backup, func(hdr tar.Header) {
+		if hdr.Typeflag == '?' && cached[hdr.Name] {
+			stale = true
+		}
+	}); err != nil {
+		return false
+	}
+	return stale
+}
+
+// readnewbackup reads the reply of the newbackup command (returns the date of the previous complete backup)
+func readnewbackup(backup *Backup, stdout io.Reader) (previous int64, err error) {
+	if protocol > 1 {
+		var reply NewBackupReply
+		if err := json.NewDecoder(stdout).Decode(&reply); err != nil {
+			failure.Println("Protocol error:", err)
+			log.Println("Protocol error:", err)
+			return 0, err
+		}
+		if reply.Date == 0 && reply.Skipped {
+			info.Println("Backup skipped:", reply.Error)
+			return 0, errSkipped
+		}
+		if reply.Date == 0 {
+			failure.Println("Server error", reply.Error)
+			log.Println("Server error", reply.Error)
+			return 0, errors.New("Server error")
+		}
+		backup.Date, previous = reply.Date, int64(reply.Previous)
+		info.Printf("New backup: date=%d name=%q files=%d\n", backup.Date, backup.Name, backup.Count())
+		log.Printf("New backup: date=%d name=%q files=%d\n", backup.Date, backup.Name, backup.Count())
+		if previous > 0 {
+			info.Printf("Previous backup: date=%d\n", previous)
+			log.Printf("Previous backup: date=%d\n", previous)
+		}
+	} else {
+		scanner := bufio.NewScanner(stdout)
+		if scanner.Scan() {
+			if d, err := strconv.ParseInt(scanner.Text(), 10, 0); err != nil {
+				failure.Println("Protocol error")
+				log.Println("Protocol error")
+				return 0, err
+			} else {
+				backup.Date = BackupID(d)
+			}
+		}
+
+		if backup.Date == 0 {
+			scanner.Scan()
+			errmsg := scanner.Text()
+			failure.Println("Server error", errmsg)
+			log.Println("Server error", errmsg)
+			return 0, errors.New("Server error")
+		}
+
+		info.Printf("New backup: date=%d name=%q files=%d\n", backup.Date, backup.Name, backup.Count())
+		log.Printf("New backup: date=%d name=%q files=%d\n", backup.Date, backup.Name, backup.Count())
+		if scanner.Scan() {
+			previous, _ = strconv.ParseInt(scanner.Text(), 10, 0)
+			if previous > 0 {
+				info.Printf("Previous backup: date=%d\n", previous)
+				log.Printf("Previous backup: date=%d\n", previous)
+			}
+		}
+	}
+
 	return
 }
 
@@ -183,9 +282,8 @@ func process(c string, backup *Backup, action func(tar.Header), files ...string)
 
 		switch hdr.Typeflag {
 		case tar.TypeXGlobalHeader:
-			var header BackupInfo
-			dec := gob.NewDecoder(tr)
-			if err := dec.Decode(&header); err != nil {
+			header, err := ReadBackupInfo(tr)
+			if err != nil {
 				failure.Println("Protocol error:", err)
 				log.Println(err)
 				return err
@@ -199,6 +297,15 @@ func process(c string, backup *Backup, action func(tar.Header), files ...string)
 			}
 			hdr.Xattrs["backup.files"] = fmt.Sprintf("%d", header.Files)
 			hdr.Xattrs["backup.schedule"] = header.Schedule
+			if header.Pinned {
+				hdr.Xattrs["backup.pinned"] = "true"
+			}
+			if header.Label != "" {
+				hdr.Xattrs["backup.label"] = header.Label
+			}
+			if header.Comment != "" {
+				hdr.Xattrs["backup.comment"] = header.Comment
+			}
 
 			action(*hdr)
 		default:
@@ -226,6 +333,7 @@ func checkmetadata(backup *Backup, files ...string) (fail error) {
 	return process("metadata", backup, func(hdr tar.Header) {
 		if Check(hdr, true) == OK {
 			backup.Forget(hdr.Name)
+			state.Keep(hdr.Name, hdr.Xattrs["backup.hash"])
 		}
 	}, files...)
 }
@@ -243,6 +351,9 @@ func resume() {
 		failure.Fatal("Too many parameters: ", strings.Join(flag.Args(), " "))
 	}
 
+	UseSession()
+	defer CloseSession()
+
 	if err := doresume(date, name); err != nil {
 		failure.Fatal("Backup failure.")
 	}
@@ -252,6 +363,10 @@ func doresume(date BackupID, name string) (fail error) {
 	log.Printf("Resuming backup: date=%d\n", date)
 	info.Printf("Resuming backup: date=%d\n", date)
 
+	if state == nil {
+		state = LoadState(name)
+	}
+
 	backup := NewBackup(cfg)
 	backup.Init(date, name)
 	if err := checkmetadata(backup); err != nil {
@@ -275,12 +390,44 @@ func doresume(date BackupID, name string) (fail error) {
 
 	info.Printf("Resuming backup: date=%d files=%d\n", backup.Date, backup.Count())
 	log.Printf("Resuming backup: date=%d files=%d\n", backup.Date, backup.Count())
-	dumpfiles(backup.Count(), backup)
+	if _, complete := dumpfiles(backup.Count(), backup); complete {
+		if err := state.Commit(backup.Date); err != nil {
+			log.Println("Could not save state cache:", err)
+		}
+	}
 
 	return
 }
 
-func dumpfiles(files int, backup *Backup) (bytes int64) {
+// writeglobalheader starts the tar stream sent to submitfiles
+func writeglobalheader(tw *tar.Writer, backup *Backup, files int) {
+	var globaldata []byte
+	if Capable(capJSON) {
+		globaldata = []byte(JSON(BackupInfo{
+			Date:     backup.Date,
+			Name:     backup.Name,
+			Schedule: backup.Schedule,
+			Files:    int64(files),
+		}))
+	} else {
+		globaldata = paxHeaders(map[string]interface{}{
+			".name":     backup.Name,
+			".schedule": backup.Schedule,
+			".version":  fmt.Sprintf("%d.%d", versionMajor, versionMinor),
+		})
+	}
+	globalhdr := &tar.Header{
+		Name:     backup.Name,
+		Size:     int64(len(globaldata)),
+		Linkname: backup.Schedule,
+		ModTime:  time.Unix(int64(backup.Date), 0),
+		Typeflag: tar.TypeXGlobalHeader,
+	}
+	tw.WriteHeader(globalhdr)
+	tw.Write(globaldata)
+}
+
+func dumpfiles(files int, backup *Backup) (bytes int64, complete bool) {
 	done := files - backup.Count()
 	bytes = 0
 
@@ -292,6 +439,8 @@ func dumpfiles(files int, backup *Backup) (bytes int64) {
 	}
 
 	cmd := remotecommand(cmdline...)
+	var output strings.Builder
+	cmd.Stdout = &output
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		failure.Println("Backend error:", err)
@@ -308,20 +457,7 @@ func dumpfiles(files int, backup *Backup) (bytes int64) {
 	tw := tar.NewWriter(stdin)
 	defer tw.Close()
 
-	globaldata := paxHeaders(map[string]interface{}{
-		".name":     backup.Name,
-		".schedule": backup.Schedule,
-		".version":  fmt.Sprintf("%d.%d", versionMajor, versionMinor),
-	})
-	globalhdr := &tar.Header{
-		Name:     backup.Name,
-		Size:     int64(len(globaldata)),
-		Linkname: backup.Schedule,
-		ModTime:  time.Unix(int64(backup.Date), 0),
-		Typeflag: tar.TypeXGlobalHeader,
-	}
-	tw.WriteHeader(globalhdr)
-	tw.Write(globaldata)
+	writeglobalheader(tw, backup, files)
 
 	backup.ForEach(func(f string) {
 		debug.Println("Sending", f)
@@ -362,8 +498,13 @@ func dumpfiles(files int, backup *Backup) (bytes int64) {
 					} else {
 						var written int64
 						buf := make([]byte, 1024*1024) // 1MiB
+						hash := GitHash(hdr.Size)
 
 						tw.WriteHeader(hdr)
+						if h, ok := stdin.(Hinter); ok {
+							h.Hint(Compressible(f))
+							defer h.Hint(true)
+						}
 						for {
 							nr, er := file.Read(buf)
 							if er == io.EOF {
@@ -383,6 +524,7 @@ func dumpfiles(files int, backup *Backup) (bytes int64) {
 									log.Println("Could not send ", f, ": ", ew)
 									return
 								} else {
+									hash.Write(buf[0:nw])
 									written += int64(nw)
 								}
 							}
@@ -395,11 +537,14 @@ func dumpfiles(files int, backup *Backup) (bytes int64) {
 
 						if written != hdr.Size {
 							log.Printf("Could not backup file=%q msg=\"size changed during backup\" name=%q date=%d error=warn\n", f, name, backup.Date)
+						} else {
+							state.Record(f, hdr, HashString(hash))
 						}
 						bytes += written
 					}
 				} else {
 					tw.WriteHeader(hdr)
+					state.Record(f, hdr, "")
 				}
 				done++
 			} else {
@@ -419,7 +564,12 @@ func dumpfiles(files int, backup *Backup) (bytes int64) {
 	info.Println("done.")
 	info.Println(Bytes(uint64(float32(bytes)/float32(time.Since(backup.Started).Seconds()))) + "/s")
 
-	return bytes
+	reply, err := ReadSubmitReply(strings.NewReader(output.String()))
+	if err != nil {
+		log.Println(cmd.Args, err)
+	}
+	complete = err == nil && reply.Date == backup.Date && reply.Complete
+	return bytes, complete
 }
 
 func history() {
@@ -432,6 +582,7 @@ func history() {
 	flag.StringVar(&schedule, "r", schedule, "-schedule")
 	flag.Var(&date, "date", "Backup set")
 	flag.Var(&date, "d", "-date")
+	flag.StringVar(&label, "label", "", "Backup label")
 	Setup()
 
 	if name == "" && !cfg.IsServer() {
@@ -442,6 +593,10 @@ func history() {
 		name = ""
 	}
 
+	if label != "" {
+		date = labelled(name, label)
+	}
+
 	backup := NewBackup(cfg)
 	backup.Init(date, name)
 	backup.Schedule = schedule
@@ -494,6 +649,7 @@ func list() {
 	flag.Var(&date, "d", "-date")
 	flag.BoolVar(&short, "short", short, "Concise output")
 	flag.BoolVar(&short, "s", short, "-short")
+	flag.StringVar(&label, "label", "", "Backup label")
 	Setup()
 
 	if name == "" && !cfg.IsServer() {
@@ -504,6 +660,10 @@ func list() {
 		name = ""
 	}
 
+	if label != "" {
+		date = labelled(name, label)
+	}
+
 	if date == 0 && len(flag.Args()) != 0 {
 		date.Set("now")
 	}
@@ -534,6 +694,15 @@ func list() {
 				fmt.Println("Date:    ", hdr.ModTime.Unix())
 				fmt.Println("Name:    ", hdr.Name)
 				fmt.Println("Schedule:", hdr.Xattrs["backup.schedule"])
+				if hdr.Xattrs["backup.pinned"] != "" {
+					fmt.Println("Pinned:   yes")
+				}
+				if hdr.Xattrs["backup.label"] != "" {
+					fmt.Println("Label:   ", hdr.Xattrs["backup.label"])
+				}
+				if hdr.Xattrs["backup.comment"] != "" {
+					fmt.Println("Comment: ", hdr.Xattrs["backup.comment"])
+				}
 				fmt.Println("Started: ", hdr.ModTime)
 				if !hdr.ChangeTime.IsZero() && hdr.ChangeTime.Unix() != 0 {
 					fmt.Println("Finished:", hdr.ChangeTime)
@@ -551,6 +720,12 @@ func list() {
 				if !hdr.ChangeTime.IsZero() && hdr.ChangeTime.Unix() != 0 {
 					fmt.Print(" ", hdr.ChangeTime.Format("Mon Jan 2 15:04"))
 				}
+				if hdr.Xattrs["backup.label"] != "" {
+					fmt.Printf(" [%s]", hdr.Xattrs["backup.label"])
+				}
+				if hdr.Xattrs["backup.pinned"] != "" {
+					fmt.Print(" (pinned)")
+				}
 				fmt.Println()
 			}
 		default:
@@ -591,11 +766,12 @@ func list() {
 
 // Client represents a dashboard line
 type Client struct {
-	Name  string
-	First time.Time
-	Last  map[string]time.Time
-	Size  int64
-	Count int64
+	Name   string
+	First  time.Time
+	Last   map[string]time.Time
+	Size   int64
+	Count  int64
+	Pinned int64
 }
 
 func dashboard() {
@@ -641,6 +817,9 @@ func dashboard() {
 						client.Size = hdr.Size
 					}
 					client.Count++
+					if hdr.Xattrs["backup.pinned"] != "" {
+						client.Pinned++
+					}
 
 					clients[hdr.Name] = client
 				} else {
@@ -650,6 +829,9 @@ func dashboard() {
 					client.Last[hdr.Xattrs["backup.schedule"]] = hdr.ModTime
 					client.Size = hdr.Size
 					client.Count++
+					if hdr.Xattrs["backup.pinned"] != "" {
+						client.Pinned++
+					}
 
 					clients[hdr.Name] = client
 				}
@@ -661,11 +843,10 @@ func dashboard() {
 		log.Fatal(err)
 	}
 
-	delete(schedules, "daily")
-	delete(schedules, "weekly")
-	delete(schedules, "monthly")
-	delete(schedules, "yearly")
-	allschedules := []string{"daily", "weekly", "monthly", "yearly"}
+	allschedules := cfg.ScheduleNames()
+	for _, s := range allschedules {
+		delete(schedules, s)
+	}
 	for s := range schedules {
 		allschedules = append(allschedules, s)
 	}
@@ -673,6 +854,9 @@ func dashboard() {
 	for name, client := range clients {
 		fmt.Println("Name:          ", name)
 		fmt.Println("Backups:       ", client.Count)
+		if client.Pinned > 0 {
+			fmt.Println("Pinned:        ", client.Pinned)
+		}
 		fmt.Println("First:         ", client.First)
 		for _, schedule := range allschedules {
 			if when, ok := client.Last[schedule]; ok {
@@ -703,9 +887,14 @@ func ping() {
 	cmd := remotecommand("version")
 
 	info.Println("Backend:", cmd.Path)
+	if verbose {
+		info.Println("Protocol:", protocol)
+		if len(capabilities) > 0 && protocol > 1 {
+			info.Println("Capabilities:", strings.Join(capabilities, " "))
+		}
+	}
 
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
 
 	info.Println()
 
@@ -743,6 +932,15 @@ func register() {
 		info.Println("User:", cfg.User)
 	}
 
+	if ishttp() {
+		fmt.Println("Error registering client: HTTP(S) clients are authenticated by token or certificate")
+		log.Fatal("Error registering client: HTTP(S) clients are authenticated by token or certificate")
+	}
+	if isvault() {
+		fmt.Println("Error registering client: backups are stored in a local folder")
+		log.Fatal("Error registering client: backups are stored in a local folder")
+	}
+
 	if err := sshcopyid(); err != nil {
 		fmt.Println("Error registering client:", err)
 		log.Fatal("Error registering client:", err)
@@ -754,11 +952,16 @@ func register() {
 
 func verify() {
 	date = 0
+	spec := ""
+	directory := "/"
 
 	flag.StringVar(&name, "name", defaultName, "Backup name")
 	flag.StringVar(&name, "n", defaultName, "-name")
 	flag.Var(&date, "date", "Backup set")
 	flag.Var(&date, "d", "-date")
+	flag.StringVar(&spec, "mtree", "", "Verify files against an mtree(5) specification instead of a backup")
+	flag.StringVar(&directory, "directory", directory, "Root of the tree described by the mtree(5) specification")
+	flag.StringVar(&directory, "C", directory, "-directory")
 
 	if date == 0 {
 		date.Set("now")
@@ -766,6 +969,25 @@ func verify() {
 
 	Setup()
 
+	if spec != "" {
+		modified, missing, err := verifymtree(spec, directory)
+		if err != nil {
+			failure.Println(err)
+			log.Fatal(err)
+		}
+		fmt.Println("Modified:", modified)
+		fmt.Println("Missing: ", missing)
+		if modified+missing > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	UseSession()
+	defer CloseSession()
+
+	state = LoadState(name)
+
 	backup := NewBackup(cfg)
 	backup.Init(date, name)
 
@@ -873,7 +1095,6 @@ func purge() {
 	cmd := remotecommand(args...)
 
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
 
 	if err := cmd.Start(); err != nil {
 		fmt.Println("Backend error:", err)
@@ -886,6 +1107,154 @@ func purge() {
 	}
 }
 
+// labelled returns the most recent backup with a given label
+func labelled(name string, label string) (date BackupID) {
+	if err := process("metadata", &Backup{Name: name}, func(hdr tar.Header) {
+		if hdr.Typeflag == tar.TypeXGlobalHeader && hdr.Xattrs["backup.label"] == label {
+			if d := BackupID(hdr.ModTime.Unix()); d > date {
+				date = d
+			}
+		}
+	}); err != nil {
+		failure.Println(err)
+		log.Fatal(err)
+	}
+	if date == 0 {
+		failure.Fatalf("No backup labelled %q\n", label)
+	}
+	return
+}
+
+func annotate() {
+	date = 0
+	name = ""
+
+	flag.StringVar(&name, "name", name, "Backup name")
+	flag.StringVar(&name, "n", name, "-name")
+	flag.Var(&date, "date", "Backup set")
+	flag.Var(&date, "d", "-date")
+	flag.StringVar(&label, "label", "", "Backup label")
+	flag.StringVar(&comment, "comment", "", "Backup comment")
+
+	Setup()
+
+	if len(flag.Args()) != 0 {
+		failure.Fatal("Too many parameters: ", strings.Join(flag.Args(), " "))
+	}
+
+	if name == "" && !cfg.IsServer() {
+		name = defaultName
+	}
+	if date == 0 {
+		failure.Fatal("Missing backup date")
+	}
+
+	args := []string{"annotatebackup", "-name", name, "-date", fmt.Sprintf("%d", date)}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "label":
+			args = append(args, "-label", label)
+		case "comment":
+			args = append(args, "-comment", comment)
+		}
+	})
+	cmd := remotecommand(args...)
+
+	cmd.Stdout = os.Stdout
+
+	if err := cmd.Start(); err != nil {
+		fmt.Println("Backend error:", err)
+		log.Fatal(cmd.Args, err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		fmt.Println("Backend error:", err)
+		log.Fatal(cmd.Args, err)
+	}
+}
+
+func pin(unpin bool) {
+	date = 0
+	name = ""
+
+	flag.StringVar(&name, "name", name, "Backup name")
+	flag.StringVar(&name, "n", name, "-name")
+	flag.Var(&date, "date", "Backup set")
+	flag.Var(&date, "d", "-date")
+
+	Setup()
+
+	if len(flag.Args()) != 0 {
+		failure.Fatal("Too many parameters: ", strings.Join(flag.Args(), " "))
+	}
+
+	if name == "" && !cfg.IsServer() {
+		name = defaultName
+	}
+	if date == 0 {
+		failure.Fatal("Missing backup date")
+	}
+
+	args := []string{"pinbackup", "-name", name, "-date", fmt.Sprintf("%d", date)}
+	if unpin {
+		args = append(args, "-unpin")
+	}
+	cmd := remotecommand(args...)
+
+	cmd.Stdout = os.Stdout
+
+	if err := cmd.Start(); err != nil {
+		fmt.Println("Backend error:", err)
+		log.Fatal(cmd.Args, err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		fmt.Println("Backend error:", err)
+		log.Fatal(cmd.Args, err)
+	}
+}
+
+func cat() {
+	date.Set("now")
+
+	flag.StringVar(&name, "name", defaultName, "Backup name")
+	flag.StringVar(&name, "n", defaultName, "-name")
+	flag.Var(&date, "date", "Backup set")
+	flag.Var(&date, "d", "-date")
+	flag.StringVar(&label, "label", "", "Backup label")
+
+	Setup()
+
+	if len(flag.Args()) == 0 {
+		failure.Fatal("Missing file name")
+	}
+
+	if label != "" {
+		date = labelled(name, label)
+	}
+
+	args := []string{"catfile", "-name", name, "-date", fmt.Sprintf("%d", date)}
+	for _, f := range flag.Args() {
+		if abs, err := filepath.Abs(f); err == nil {
+			f = abs
+		}
+		args = append(args, f)
+	}
+	cmd := remotecommand(args...)
+
+	cmd.Stdout = os.Stdout
+
+	if err := cmd.Start(); err != nil {
+		failure.Println("Backend error:", err)
+		log.Fatal(cmd.Args, err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		log.Println(cmd.Args, err)
+		os.Exit(exitstatus(err))
+	}
+}
+
 func archive() {
 	gz := false
 	var output string
@@ -900,16 +1269,27 @@ func archive() {
 	flag.StringVar(&output, "f", "", "-file")
 	flag.BoolVar(&gz, "gzip", gz, "Compress archive using gzip")
 	flag.BoolVar(&gz, "z", gz, "-gzip")
+	flag.StringVar(&label, "label", "", "Backup label")
 
 	Setup()
 
+	if label != "" {
+		date = labelled(name, label)
+	}
+
 	if output == "" {
 		fmt.Println("Missing output file")
 		os.Exit(1)
 	}
 
-	if ext := filepath.Ext(output); ext == ".gz" || ext == ".tgz" {
+	format := ""
+	switch filepath.Ext(output) {
+	case ".gz", ".tgz":
 		gz = true
+	case ".zst", ".tzst":
+		format = compressZstd
+	case ".xz", ".txz":
+		format = "xz"
 	}
 
 	args := []string{"data"}
@@ -929,12 +1309,28 @@ func archive() {
 
 		cmd.Stdout = out
 	}
-	cmd.Stderr = os.Stderr
 
-	if gz {
+	switch {
+	case gz:
 		gzw := gzip.NewWriter(cmd.Stdout)
 		defer gzw.Close()
 		cmd.Stdout = gzw
+	case format == compressZstd:
+		zw, err := zstd.NewWriter(cmd.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			log.Fatal(err)
+		}
+		defer zw.Close()
+		cmd.Stdout = zw
+	case format == "xz":
+		xw, err := xz.NewWriter(cmd.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			log.Fatal(err)
+		}
+		defer xw.Close()
+		cmd.Stdout = xw
 	}
 
 	if err := cmd.Start(); err != nil {
@@ -950,11 +1346,13 @@ func archive() {
 
 func expire() {
 	keep := 0
+	planonly := false
 	name = ""
 	flag.StringVar(&name, "name", name, "Backup name")
 	flag.StringVar(&name, "n", name, "-name")
-	flag.StringVar(&schedule, "schedule", defaultSchedule, "Backup schedule")
-	flag.StringVar(&schedule, "r", defaultSchedule, "-schedule")
+	schedule = ""
+	flag.StringVar(&schedule, "schedule", schedule, "Backup schedules (default: all)")
+	flag.StringVar(&schedule, "r", schedule, "-schedule")
 	flag.IntVar(&keep, "keep", keep, "Minimum number of backups to keep")
 	flag.IntVar(&keep, "k", keep, "-keep")
 
@@ -962,6 +1360,7 @@ func expire() {
 	flag.Var(&date, "a", "-age")
 	flag.Var(&date, "date", "-age")
 	flag.Var(&date, "d", "-age")
+	flag.BoolVar(&planonly, "plan", planonly, "Only show which backups would be kept or deleted")
 
 	Setup()
 
@@ -973,36 +1372,73 @@ func expire() {
 		failure.Fatal("Too many parameters: ", strings.Join(flag.Args(), " "))
 	}
 
-	info.Printf("Expiring backups for %q, schedule %q\n", name, schedule)
-
 	if name == "*" {
 		name = ""
 	}
 
-	args := []string{"expirebackup"}
-	if date > 0 {
-		args = append(args, "-date", fmt.Sprintf("%d", date))
-	}
-	if name != "" {
-		args = append(args, "-name", name)
-	}
-	if keep > 0 {
-		args = append(args, "-keep", fmt.Sprintf("%d", keep))
+	schedules := []string{schedule}
+	if date <= 0 && profile != "" && schedule == "" { // the profile may define a different expiration for some schedules
+		others := []string{}
+		schedules = []string{}
+		for _, s := range cfg.ScheduleNames() {
+			if cfg.Profile[profile].Expiration.Days(s) > 0 {
+				schedules = append(schedules, s)
+			} else {
+				others = append(others, s)
+			}
+		}
+		if len(schedules) == 0 {
+			schedules = []string{""}
+		} else if len(others) > 0 {
+			schedules = append(schedules, strings.Join(others, ","))
+		}
 	}
-	args = append(args, "-schedule", schedule)
-	cmd := remotecommand(args...)
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	for _, schedule := range schedules {
+		expdate := date
+		if date <= 0 && profile != "" {
+			for _, s := range strings.Split(schedule, ",") {
+				if days := cfg.Profile[profile].Expiration.Days(s); days > 0 {
+					expdate = BackupID(time.Now().Unix() - days*24*60*60)
+				}
+			}
+		}
 
-	if err := cmd.Start(); err != nil {
-		fmt.Println("Backend error:", err)
-		log.Fatal(cmd.Args, err)
-	}
+		if schedule == "" {
+			info.Printf("Expiring backups for %q\n", name)
+		} else {
+			info.Printf("Expiring backups for %q, schedule %q\n", name, schedule)
+		}
 
-	if err := cmd.Wait(); err != nil {
-		fmt.Println("Backend error:", err)
-		log.Fatal(cmd.Args, err)
+		args := []string{"expirebackup"}
+		if expdate > 0 {
+			args = append(args, "-date", fmt.Sprintf("%d", expdate))
+		}
+		if name != "" {
+			args = append(args, "-name", name)
+		}
+		if keep > 0 {
+			args = append(args, "-keep", fmt.Sprintf("%d", keep))
+		}
+		if planonly {
+			args = append(args, "-plan")
+		}
+		if schedule != "" {
+			args = append(args, "-schedule", schedule)
+		}
+		cmd := remotecommand(args...)
+
+		cmd.Stdout = os.Stdout
+
+		if err := cmd.Start(); err != nil {
+			fmt.Println("Backend error:", err)
+			log.Fatal(cmd.Args, err)
+		}
+
+		if err := cmd.Wait(); err != nil {
+			fmt.Println("Backend error:", err)
+			log.Fatal(cmd.Args, err)
+		}
 	}
 }
 
@@ -1020,9 +1456,14 @@ func restore() {
 	flag.Var(&date, "d", "-date")
 	flag.BoolVar(&inplace, "in-place", inplace, "Restore in-place")
 	flag.BoolVar(&inplace, "inplace", inplace, "-in-place")
+	flag.StringVar(&label, "label", "", "Backup label")
 
 	Setup()
 
+	if label != "" {
+		date = labelled(name, label)
+	}
+
 	if inplace {
 		if directory != "" && directory != "/" {
 			failure.Fatal("Inconsistent parameters")
@@ -1036,7 +1477,6 @@ func restore() {
 	args = append(args, "-name", name)
 	args = append(args, flag.Args()...)
 	getdata := remotecommand(args...)
-	getdata.Stderr = os.Stderr
 
 	args = []string{}
 	args = append(args, "-x", "-p", "-f", "-")
@@ -1065,3 +1505,298 @@ func restore() {
 		log.Fatal(tar.Args, err)
 	}
 }
+
+// waitjob waits for the server to queue a job for this client
+func waitjob(wait int) (*Job, error) {
+	cmd := remotecommand("nextjob", "-name", name, "-wait", strconv.Itoa(wait))
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	reply, _ := ioutil.ReadAll(out)
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	}
+
+	if len(strings.TrimSpace(string(reply))) == 0 {
+		return nil, nil
+	}
+	var job Job
+	if err := json.Unmarshal(reply, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// runjob runs a job and streams its output back to the server
+func runjob(job *Job) {
+	log.Printf("Running job: id=%q command=%q\n", job.ID, strings.Join(append([]string{job.Command}, job.Args...), " "))
+
+	status := remotecommand("jobstatus", "-name", name, "-id", job.ID)
+	stdin, err := status.StdinPipe()
+	if err != nil {
+		log.Println(status.Args, err)
+		return
+	}
+	if err := status.Start(); err != nil {
+		log.Println(status.Args, err)
+		return
+	}
+
+	output := make(chan struct{})
+	r, w := io.Pipe()
+	go func() {
+		defer close(output)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			fmt.Fprintln(stdin, scanner.Text())
+			if f, ok := stdin.(interface{ Flush() error }); ok {
+				f.Flush() // send each line as soon as possible
+			}
+		}
+		io.Copy(ioutil.Discard, r)
+	}()
+
+	args, err := checkjob(job.Command, job.Args, true) // don't blindly trust the server
+	if err == nil {
+		cmdargs := []string{job.Command, "-config", configFile, "-name", name}
+		if profile != "" {
+			cmdargs = append(cmdargs, "-profile", profile)
+		}
+		cmd := exec.Command(programFile, append(cmdargs, args...)...)
+		cmd.Stdout = w
+		cmd.Stderr = w
+		err = cmd.Run()
+	}
+	code := exitstatus(err)
+	if code < 0 {
+		fmt.Fprintln(w, err)
+		code = 1
+	}
+
+	w.Close()
+	<-output
+	stdin.Close()
+	status.Wait()
+
+	if err := remotecommand("jobstatus", "-name", name, "-id", job.ID, "-exit", strconv.Itoa(code)).Run(); err != nil {
+		log.Printf("Job status: id=%q msg=%q error=warn\n", job.ID, err)
+	}
+	log.Printf("Finished job: id=%q status=%d\n", job.ID, code)
+}
+
+func auto() {
+	wait := 60
+	flag.StringVar(&name, "name", defaultName, "Backup name")
+	flag.StringVar(&name, "n", defaultName, "-name")
+	flag.IntVar(&wait, "wait", wait, "Interval between checks for jobs (in seconds)")
+	Setup()
+	cfg.ClientOnly()
+
+	if len(flag.Args()) != 0 {
+		failure.Fatal("Too many parameters: ", strings.Join(flag.Args(), " "))
+	}
+
+	negotiate()
+	if !Capable(capJobs) {
+		failure.Fatal("The server does not support jobs.")
+	}
+
+	log.Printf("Waiting for jobs: name=%q server=%q\n", name, cfg.Server)
+	info.Println("Waiting for jobs from", cfg.Server)
+	for {
+		UseSession() // keep a single connection to the server
+		job, err := waitjob(wait)
+		if err != nil {
+			log.Printf("Waiting for jobs: name=%q msg=%q error=warn\n", name, err)
+			time.Sleep(time.Duration(wait) * time.Second)
+			continue
+		}
+		if job != nil {
+			info.Println("Running job", job.ID+":", job.Command, strings.Join(job.Args, " "))
+			runjob(job)
+		}
+	}
+}
+
+// storable checks whether a tar entry describes a file (and returns its absolute name)
+func storable(hdr *tar.Header) (string, bool) {
+	if hdr.Typeflag == tar.TypeXHeader || hdr.Typeflag == tar.TypeXGlobalHeader || hdr.Name == hdr.Linkname {
+		return "", false
+	}
+	return filepath.Join(string(filepath.Separator), hdr.Name), true
+}
+
+func store() {
+	date = -1
+	flag.StringVar(&name, "name", defaultName, "Backup name")
+	flag.StringVar(&name, "n", defaultName, "-name")
+	flag.Var(&date, "date", "Backup set")
+	flag.Var(&date, "d", "-date")
+	flag.StringVar(&schedule, "schedule", "", "Backup schedule")
+	flag.StringVar(&schedule, "r", "", "-schedule")
+	Setup()
+
+	if len(flag.Args()) != 0 {
+		failure.Fatal("Too many parameters: ", strings.Join(flag.Args(), " "))
+	}
+	if IsATTY(os.Stdin) {
+		failure.Fatal("Usage: ", programName, " store [options] < file.tar")
+	}
+
+	// the archive is read twice: spool it unless it's a regular file
+	archive := os.Stdin
+	if fi, err := archive.Stat(); err != nil || !fi.Mode().IsRegular() {
+		spool, err := ioutil.TempFile("", programName)
+		if err != nil {
+			failure.Fatal(err)
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		if _, err := io.Copy(spool, os.Stdin); err != nil {
+			failure.Fatal("Could not read archive: ", err)
+		}
+		archive = spool
+	}
+
+	backup := NewBackup(cfg)
+	backup.Init(0, name)
+	backup.Schedule = schedule
+	backup.Started = time.Now()
+
+	archive.Seek(0, io.SeekStart)
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			failure.Fatal("Could not read archive: ", err)
+		}
+		if f, ok := storable(hdr); ok {
+			backup.Add(f)
+		}
+	}
+	files := backup.Count()
+	if files == 0 {
+		failure.Fatal("Empty archive")
+	}
+
+	log.Printf("Storing archive: name=%q files=%d\n", name, files)
+
+	cmdline := []string{"newbackup", "-name", name, "-full=true"}
+	if date > 0 {
+		cmdline = append(cmdline, "-date", fmt.Sprintf("%d", date))
+	}
+	if schedule != "" {
+		cmdline = append(cmdline, "-schedule", schedule)
+	}
+	if force {
+		cmdline = append(cmdline, "-force")
+	}
+
+	cmd := remotecommand(cmdline...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		failure.Println("Backend error:", err)
+		log.Fatal(cmd.Args, err)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		failure.Println("Backend error:", err)
+		log.Fatal(cmd.Args, err)
+	}
+	if err := cmd.Start(); err != nil {
+		failure.Println("Backend error:", err)
+		log.Fatal(cmd.Args, err)
+	}
+	backup.ForEach(func(f string) { fmt.Fprintln(stdin, strconv.Quote(f)) })
+	stdin.Close()
+	if _, err := readnewbackup(backup, stdout); err != nil {
+		failure.Fatal("Backup failure.")
+	}
+	if err := cmd.Wait(); err != nil {
+		failure.Println("Backend error:", err)
+		log.Fatal(cmd.Args, err)
+	}
+
+	cmdline = []string{"submitfiles", "-name", backup.Name, "-date", fmt.Sprintf("%d", backup.Date)}
+	if backup.Schedule != "" {
+		cmdline = append(cmdline, "-schedule", backup.Schedule)
+	}
+	cmd = remotecommand(cmdline...)
+	var output strings.Builder
+	cmd.Stdout = &output
+	if stdin, err = cmd.StdinPipe(); err != nil {
+		failure.Println("Backend error:", err)
+		log.Fatal(cmd.Args, err)
+	}
+	if err := cmd.Start(); err != nil {
+		failure.Println("Backend error:", err)
+		log.Fatal(cmd.Args, err)
+	}
+
+	tw := tar.NewWriter(stdin)
+	writeglobalheader(tw, backup, files)
+
+	var bytes int64
+	archive.Seek(0, io.SeekStart)
+	tr = tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			failure.Fatal("Could not read archive: ", err)
+		}
+		f, ok := storable(hdr)
+		if !ok {
+			continue
+		}
+
+		debug.Println("Sending", f)
+		hdr.Name = f
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			failure.Fatal("Could not send ", f, ": ", err)
+		}
+		if hdr.Size > 0 {
+			if h, ok := stdin.(Hinter); ok {
+				h.Hint(Compressible(f))
+			}
+			n, err := io.Copy(tw, tr)
+			if err != nil {
+				failure.Fatal("Could not send ", f, ": ", err)
+			}
+			bytes += n
+			if h, ok := stdin.(Hinter); ok {
+				h.Hint(true)
+			}
+		}
+	}
+	tw.Close()
+	stdin.Close()
+
+	if err := cmd.Wait(); err != nil {
+		failure.Println("Backend error:", err)
+		log.Fatal(cmd.Args, err)
+	}
+
+	log.Printf("Finished sending: date=%d name=%q files=%d sent=%d duration=%.0f\n", backup.Date, name, files, bytes, time.Since(backup.Started).Seconds())
+	reply, err := ReadSubmitReply(strings.NewReader(output.String()))
+	if err != nil {
+		failure.Println("Backend error:", err)
+		log.Fatal(cmd.Args, err)
+	}
+	if reply.Date != backup.Date || !reply.Complete {
+		failure.Fatalf("Incomplete backup: %d files to go", reply.Missing)
+	}
+	info.Printf("Backup %d complete (%d files)\n", reply.Date, reply.Files)
+}
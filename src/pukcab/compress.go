@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// compression algorithms
+const (
+	compressNone = "none"
+	compressZstd = "zstd"
+	compressLZ4  = "lz4"
+)
+
+const compressChunkSize = 256 * 1024
+const maxEntropy = 7.5 // bits per byte
+
+var compression = ""
+
+// file extensions of already compressed data
+var compressed = map[string]struct{}{
+	".gz": {}, ".tgz": {}, ".bz2": {}, ".xz": {}, ".txz": {}, ".zst": {}, ".lz4": {}, ".lzma": {}, ".z": {},
+	".zip": {}, ".7z": {}, ".rar": {}, ".jar": {}, ".apk": {}, ".deb": {}, ".rpm": {},
+	".jpg": {}, ".jpeg": {}, ".png": {}, ".gif": {}, ".webp": {}, ".heic": {},
+	".mp3": {}, ".ogg": {}, ".flac": {}, ".aac": {}, ".m4a": {}, ".opus": {},
+	".mp4": {}, ".m4v": {}, ".mkv": {}, ".avi": {}, ".mov": {}, ".webm": {},
+	".docx": {}, ".xlsx": {}, ".pptx": {}, ".odt": {}, ".ods": {}, ".odp": {}, ".epub": {},
+}
+
+var zstdencoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+var zstddecoder, _ = zstd.NewReader(nil)
+
+// Compressible checks whether a file is worth compressing (judging by its name)
+func Compressible(file string) bool {
+	_, ok := compressed[strings.ToLower(filepath.Ext(file))]
+	return !ok
+}
+
+// entropy estimates the information density of data (in bits per byte)
+func entropy(data []byte) float64 {
+	if len(data) > 64*1024 {
+		data = data[:64*1024]
+	}
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	e := 0.0
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(len(data))
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
+
+// Compression returns the compression algorithm to use with the server
+func Compression() string {
+	if cfg.Server == "" || isvault() || cfg.Compression == compressNone {
+		return ""
+	}
+	if Capable(cfg.Compression) {
+		return cfg.Compression
+	}
+	return ""
+}
+
+// Hinter is implemented by writers which can be told whether data is compressible
+type Hinter interface {
+	Hint(compressible bool)
+}
+
+// CompressWriter compresses data written to it, as a stream of chunks made of a flag (1 byte:
+// 0 = raw data, 1 = compressed data), the length of the payload and the length of the uncompressed
+// data (4 bytes each, big-endian) and the payload; chunks are compressed independently, so that
+// already compressed data can be sent as-is
+type CompressWriter struct {
+	w            io.Writer
+	algorithm    string
+	buf          []byte
+	compressible bool
+}
+
+// NewCompressWriter creates a new compressed stream
+func NewCompressWriter(w io.Writer, algorithm string) *CompressWriter {
+	return &CompressWriter{
+		w:            w,
+		algorithm:    algorithm,
+		buf:          make([]byte, 0, compressChunkSize),
+		compressible: true,
+	}
+}
+
+// Hint tells whether the following data is worth compressing
+func (c *CompressWriter) Hint(compressible bool) {
+	if compressible != c.compressible {
+		c.Flush()
+		c.compressible = compressible
+	}
+}
+
+func (c *CompressWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		m := copy(c.buf[len(c.buf):cap(c.buf)], p)
+		c.buf = c.buf[:len(c.buf)+m]
+		p = p[m:]
+		n += m
+		if len(c.buf) == cap(c.buf) {
+			if err = c.Flush(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Flush sends buffered data
+func (c *CompressWriter) Flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+
+	flag := byte(0)
+	payload := c.buf
+	if c.compressible && entropy(c.buf) < maxEntropy {
+		var packed []byte
+		switch c.algorithm {
+		case compressZstd:
+			packed = zstdencoder.EncodeAll(c.buf, nil)
+		case compressLZ4:
+			packed = make([]byte, lz4.CompressBlockBound(len(c.buf)))
+			if n, err := lz4.CompressBlock(c.buf, packed, nil); err == nil && n > 0 {
+				packed = packed[:n]
+			} else {
+				packed = nil
+			}
+		}
+		if packed != nil && len(packed) < len(c.buf) {
+			flag, payload = 1, packed
+		}
+	}
+
+	var header [9]byte
+	header[0] = flag
+	binary.BigEndian.PutUint32(header[1:5], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[5:9], uint32(len(c.buf)))
+	c.buf = c.buf[:0]
+	if _, err := c.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := c.w.Write(payload)
+	return err
+}
+
+// Close flushes buffered data and closes the underlying stream
+func (c *CompressWriter) Close() error {
+	err := c.Flush()
+	if closer, ok := c.w.(io.Closer); ok {
+		if e := closer.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// CompressReader decompresses data read from it
+type CompressReader struct {
+	r         *bufio.Reader
+	c         io.Closer
+	algorithm string
+	data      []byte
+}
+
+// NewCompressReader reads a compressed stream
+func NewCompressReader(r io.Reader, algorithm string) *CompressReader {
+	c, _ := r.(io.Closer)
+	return &CompressReader{
+		r:         bufio.NewReader(r),
+		c:         c,
+		algorithm: algorithm,
+	}
+}
+
+func (c *CompressReader) Read(p []byte) (int, error) {
+	for len(c.data) == 0 {
+		var header [9]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = errors.New("Truncated compressed stream")
+			}
+			return 0, err
+		}
+		size := binary.BigEndian.Uint32(header[1:5])
+		original := binary.BigEndian.Uint32(header[5:9])
+		if size > 2*compressChunkSize || original > compressChunkSize {
+			return 0, errors.New("Invalid compressed stream")
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return 0, err
+		}
+
+		switch header[0] {
+		case 0:
+			c.data = payload
+		case 1:
+			var err error
+			switch c.algorithm {
+			case compressZstd:
+				c.data, err = zstddecoder.DecodeAll(payload, make([]byte, 0, original))
+			case compressLZ4:
+				c.data = make([]byte, original)
+				var n int
+				n, err = lz4.UncompressBlock(payload, c.data)
+				c.data = c.data[:n]
+			default:
+				err = errors.New("Unsupported compression " + c.algorithm)
+			}
+			if err != nil {
+				return 0, err
+			}
+		default:
+			return 0, errors.New("Invalid compressed stream")
+		}
+	}
+
+	n := copy(p, c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+// Close closes the underlying stream
+func (c *CompressReader) Close() error {
+	if c.c != nil {
+		return c.c.Close()
+	}
+	return nil
+}
+
+// compressstdio runs the current (server) command in a child process whose standard input and output are uncompressed
+func compressstdio() {
+	if os.Getenv("PUKCAB_COMPRESSED") != "" { // we are the child process
+		os.Unsetenv("PUKCAB_COMPRESSED")
+		return
+	}
+	if compression == "" || compression == compressNone {
+		return
+	}
+	if compression != compressZstd && compression != compressLZ4 {
+		failure.Println("Unsupported compression", compression)
+		fatal("Unsupported compression: ", compression)
+	}
+
+	os.Setenv("PUKCAB_COMPRESSED", compression)
+	cmd := exec.Command(programFile, os.Args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		LogExit(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		LogExit(err)
+	}
+	if err := cmd.Start(); err != nil {
+		LogExit(err)
+	}
+
+	go func() {
+		io.Copy(stdin, NewCompressReader(os.Stdin, compression))
+		stdin.Close()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w := NewCompressWriter(os.Stdout, compression)
+		buf := make([]byte, compressChunkSize)
+		for {
+			n, err := stdout.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				w.Flush() // don't hold back data the client may be waiting for
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	err = cmd.Wait()
+	exit(exitstatus(err))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestCompressStream(t *testing.T) {
+	random := make([]byte, 3*compressChunkSize/2)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := []byte(strings.Repeat("pukcab backs up files to a git vault\n", 20000))
+
+	tests := []struct {
+		name   string
+		chunks [][]byte
+		hints  []bool
+	}{
+		{name: "empty"},
+		{name: "text", chunks: [][]byte{text}},
+		{name: "random", chunks: [][]byte{random}},
+		{name: "small writes", chunks: [][]byte{[]byte("a"), []byte("bc"), []byte(""), []byte("def")}},
+		{name: "hints", chunks: [][]byte{text, random, text}, hints: []bool{true, false, true}},
+	}
+
+	for _, algorithm := range []string{compressZstd, compressLZ4} {
+		for _, test := range tests {
+			var stream bytes.Buffer
+			var expected []byte
+			w := NewCompressWriter(&stream, algorithm)
+			for i, chunk := range test.chunks {
+				if test.hints != nil {
+					w.Hint(test.hints[i])
+				}
+				if n, err := w.Write(chunk); n != len(chunk) || err != nil {
+					t.Fatalf("%s/%s: Write = %d, %v", algorithm, test.name, n, err)
+				}
+				expected = append(expected, chunk...)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("%s/%s: Close failed: %s", algorithm, test.name, err)
+			}
+
+			data, err := ioutil.ReadAll(NewCompressReader(bytes.NewReader(stream.Bytes()), algorithm))
+			if err != nil {
+				t.Errorf("%s/%s: reading failed: %s", algorithm, test.name, err)
+				continue
+			}
+			if !bytes.Equal(data, expected) {
+				t.Errorf("%s/%s: read %d bytes, expected %d", algorithm, test.name, len(data), len(expected))
+			}
+		}
+	}
+}
+
+func TestCompressRatio(t *testing.T) {
+	text := []byte(strings.Repeat("0123456789", 100000))
+	random := make([]byte, len(text))
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for _, algorithm := range []string{compressZstd, compressLZ4} {
+		var stream bytes.Buffer
+		w := NewCompressWriter(&stream, algorithm)
+		w.Write(text)
+		w.Close()
+		if stream.Len() >= len(text)/10 {
+			t.Errorf("%s: %d bytes compressed to %d", algorithm, len(text), stream.Len())
+		}
+
+		stream.Reset()
+		w = NewCompressWriter(&stream, algorithm)
+		w.Write(random)
+		w.Close()
+		if chunks := (len(random) + compressChunkSize - 1) / compressChunkSize; stream.Len() != len(random)+9*chunks {
+			t.Errorf("%s: %d random bytes sent as %d, expected raw chunks", algorithm, len(random), stream.Len())
+		}
+	}
+}
+
+func TestCompressReaderErrors(t *testing.T) {
+	var stream bytes.Buffer
+	w := NewCompressWriter(&stream, compressZstd)
+	w.Write([]byte(strings.Repeat("abc", 1000)))
+	w.Close()
+	valid := stream.Bytes()
+
+	tests := []struct {
+		name      string
+		stream    []byte
+		algorithm string
+	}{
+		{"truncated header", valid[:5], compressZstd},
+		{"truncated payload", valid[:len(valid)-1], compressZstd},
+		{"invalid flag", append([]byte{2}, valid[1:]...), compressZstd},
+		{"oversized chunk", []byte{0, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 1}, compressZstd},
+		{"corrupt payload", append(append([]byte{}, valid[:9]...), bytes.Repeat([]byte{0xff}, len(valid)-9)...), compressZstd},
+		{"unsupported algorithm", valid, "gzip"},
+	}
+
+	for _, test := range tests {
+		if data, err := ioutil.ReadAll(NewCompressReader(bytes.NewReader(test.stream), test.algorithm)); err == nil {
+			t.Errorf("%s: read %d bytes, expected an error", test.name, len(data))
+		}
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	tests := []struct {
+		file         string
+		compressible bool
+	}{
+		{"/etc/passwd", true},
+		{"/var/log/syslog.1", true},
+		{"/var/log/syslog.2.gz", false},
+		{"/home/user/Photo.JPG", false},
+		{"/srv/archive.tar.zst", false},
+		{"/srv/archive.tar", true},
+	}
+
+	for _, test := range tests {
+		if compressible := Compressible(test.file); compressible != test.compressible {
+			t.Errorf("Compressible(%q) = %v, expected %v", test.file, compressible, test.compressible)
+		}
+	}
+}
@@ -3,13 +3,94 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
+// Expiration defines the retention (in days) of standard schedules and failed backups
+type Expiration struct{ Daily, Weekly, Monthly, Yearly, Failed int64 }
+
+// Days returns the retention of a given schedule (or 0 if not defined)
+func (e Expiration) Days(schedule string) int64 {
+	switch schedule {
+	case "daily":
+		return e.Daily
+	case "weekly":
+		return e.Weekly
+	case "monthly":
+		return e.Monthly
+	case "yearly":
+		return e.Yearly
+	}
+	return 0
+}
+
+// Schedule defines a backup schedule: backups are promoted to it when its interval has elapsed
+type Schedule struct {
+	Name       string
+	Interval   string // e.g. "1h", "7d"
+	Expiration int64  // retention (in days)
+
+	interval time.Duration
+}
+
+// standard schedules, used unless [[schedule]] tables are configured
+var standardSchedules = []Schedule{
+	{Name: "daily", Interval: "1d", Expiration: 2 * 7, interval: 24 * time.Hour},             // 2 weeks
+	{Name: "weekly", Interval: "7d", Expiration: 6 * 7, interval: 7 * 24 * time.Hour},        // 6 weeks
+	{Name: "monthly", Interval: "31d", Expiration: 365, interval: 31 * 24 * time.Hour},       // 1 year
+	{Name: "yearly", Interval: "365d", Expiration: 10 * 365, interval: 365 * 24 * time.Hour}, // 10 years
+}
+
+// parseinterval parses a duration, with support for days ("d") and weeks ("w")
+func parseinterval(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(s, suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64)
+			if err != nil {
+				return 0, fmt.Errorf("Invalid interval %q", s)
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// Duration returns the interval of a schedule
+func (s Schedule) Duration() time.Duration {
+	return s.interval
+}
+
+// Profile overrides the configuration for a given set of backups
+type Profile struct {
+	Name     string
+	Server   string
+	User     string
+	Port     int
+	Schedule string
+	Include  []string
+	Exclude  []string
+
+	Expiration Expiration
+}
+
+// ClientConfig overrides the server policy for the backups of matching clients
+type ClientConfig struct {
+	Expiration Expiration
+	Retention  Retention
+	Keep       int      // minimum number of backups to keep
+	Interval   string   // minimum time between 2 backups
+	Quota      string   // maximum space used by all the backups of a client in the vault (e.g. "50GiB")
+	Schedules  []string // allowed schedules
+}
+
 // Config is used to store configuration
 type Config struct {
 	Server  string
@@ -17,18 +98,44 @@ type Config struct {
 	Command string
 	Tar     string
 	Port    int
+	Cache   string
+	Restore string // where jobs may restore files over existing ones
 	Include []string
 	Exclude []string
 
+	SSH        string
+	Identity   []string
+	KnownHosts string
+	HostKey    string
+	Keepalive  int
+
+	Compression string
+	Token       string
+	Tokens      map[string]string
+	Certificate string
+	Key         string
+	CA          string
+
 	Vault   string
 	Catalog string
 	Web     string
 	WebRoot string
+	API     string // where the HTTP(S) transport listens (separately from the web interface)
 
 	Maxtries int
+	Interval string // minimum time between 2 backups of a client
+	Keep     int    // minimum number of backups to keep for each client
 	Debug    bool
 
-	Expiration struct{ Daily, Weekly, Monthly, Yearly int64 }
+	Expiration Expiration
+	Retention  Retention
+	Schedule   []Schedule
+	Profile    map[string]Profile
+	Clients    map[string]ClientConfig `toml:"client"`
+
+	interval time.Duration
+	quota    int64
+	allowed  []string
 }
 
 var cfg Config
@@ -37,13 +144,13 @@ var configFile = defaultConfig
 // Load parses a configuration file
 func (cfg *Config) Load(filename string) {
 	if _, err := toml.DecodeFile(filename, &cfg); err != nil && !os.IsNotExist(err) {
-		fmt.Fprintln(os.Stderr, "Failed to parse configuration: ", err)
-		log.Fatal("Failed to parse configuration: ", err)
+		fmt.Fprintln(cmderr, "Failed to parse configuration: ", err)
+		fatal("Failed to parse configuration: ", err)
 	}
 
 	if _, err := toml.DecodeFile(filepath.Join(os.Getenv("HOME"), defaultUserConfig), &cfg); err != nil && !os.IsNotExist(err) {
-		fmt.Fprintln(os.Stderr, "Failed to parse configuration: ", err)
-		log.Fatal("Failed to parse configuration:", err)
+		fmt.Fprintln(cmderr, "Failed to parse configuration: ", err)
+		fatal("Failed to parse configuration:", err)
 	}
 
 	if len(cfg.Include) < 1 {
@@ -61,6 +168,18 @@ func (cfg *Config) Load(filename string) {
 	if len(cfg.Command) < 1 {
 		cfg.Command = programName
 	}
+	if len(cfg.Cache) < 1 {
+		cfg.Cache = defaultCache
+	}
+	if len(cfg.KnownHosts) < 1 {
+		cfg.KnownHosts = filepath.Join(cfg.Cache, "known_hosts")
+	}
+	if cfg.Keepalive == 0 {
+		cfg.Keepalive = defaultKeepalive
+	}
+	if len(cfg.Compression) < 1 {
+		cfg.Compression = compressZstd
+	}
 	if len(cfg.Tar) < 1 {
 		cfg.Tar = "tar"
 	}
@@ -69,6 +188,48 @@ func (cfg *Config) Load(filename string) {
 		cfg.Maxtries = defaultMaxtries
 	}
 
+	for i, s := range cfg.Schedule {
+		d, err := parseinterval(s.Interval)
+		if s.Name == "" || err != nil || d <= 0 {
+			fmt.Fprintf(cmderr, "Invalid schedule %q: interval=%q\n", s.Name, s.Interval)
+			fatalf("Invalid schedule: name=%q interval=%q\n", s.Name, s.Interval)
+		}
+		cfg.Schedule[i].interval = d
+	}
+	if cfg.Interval != "" {
+		d, err := parseinterval(cfg.Interval)
+		if err != nil {
+			fmt.Fprintf(cmderr, "Invalid interval %q\n", cfg.Interval)
+			fatalf("Invalid interval: interval=%q\n", cfg.Interval)
+		}
+		cfg.interval = d
+	}
+
+	for pattern, c := range cfg.Clients {
+		if _, err := path.Match(pattern, ""); err != nil {
+			fmt.Fprintf(cmderr, "Invalid client %q\n", pattern)
+			fatalf("Invalid client: client=%q\n", pattern)
+		}
+		if _, err := parseinterval(c.Interval); c.Interval != "" && err != nil {
+			fmt.Fprintf(cmderr, "Invalid interval for client %q: interval=%q\n", pattern, c.Interval)
+			fatalf("Invalid interval: client=%q interval=%q\n", pattern, c.Interval)
+		}
+		if _, err := ParseBytes(c.Quota); c.Quota != "" && err != nil {
+			fmt.Fprintf(cmderr, "Invalid quota for client %q: quota=%q\n", pattern, c.Quota)
+			fatalf("Invalid quota: client=%q quota=%q\n", pattern, c.Quota)
+		}
+	}
+
+	sort.SliceStable(cfg.Schedule, func(i, j int) bool { return cfg.Schedule[i].interval < cfg.Schedule[j].interval })
+	if cfg.IsServer() {
+		for _, s := range cfg.Schedule {
+			if cfg.ExpirationDays(s.Name) <= 0 { // the server must know when to expire backups
+				fmt.Fprintf(cmderr, "Invalid schedule %q: missing expiration\n", s.Name)
+				fatalf("Invalid schedule: name=%q msg=\"missing expiration\"\n", s.Name)
+			}
+		}
+	}
+
 	if cfg.IsServer() {
 		if pw, err := Getpwnam(cfg.User); err == nil {
 			if filepath.IsAbs(cfg.Vault) {
@@ -82,6 +243,141 @@ func (cfg *Config) Load(filename string) {
 	return
 }
 
+// UseProfile applies the settings of a named profile
+func (cfg *Config) UseProfile(p string) error {
+	profile, ok := cfg.Profile[p]
+	if !ok {
+		return fmt.Errorf("Unknown profile %q", p)
+	}
+
+	if profile.Server != "" {
+		cfg.Server = profile.Server
+	}
+	if profile.User != "" {
+		cfg.User = profile.User
+	}
+	if profile.Port != 0 {
+		cfg.Port = profile.Port
+	}
+	if len(profile.Include) > 0 {
+		cfg.Include = profile.Include
+	}
+	if len(profile.Exclude) > 0 {
+		cfg.Exclude = profile.Exclude
+	}
+	if profile.Expiration.Daily != 0 {
+		cfg.Expiration.Daily = profile.Expiration.Daily
+	}
+	if profile.Expiration.Weekly != 0 {
+		cfg.Expiration.Weekly = profile.Expiration.Weekly
+	}
+	if profile.Expiration.Monthly != 0 {
+		cfg.Expiration.Monthly = profile.Expiration.Monthly
+	}
+	if profile.Expiration.Yearly != 0 {
+		cfg.Expiration.Yearly = profile.Expiration.Yearly
+	}
+
+	return nil
+}
+
+// Schedules returns the configured backup schedules, shortest interval first
+func (cfg *Config) Schedules() []Schedule {
+	if len(cfg.Schedule) > 0 {
+		return cfg.Schedule
+	}
+	return standardSchedules
+}
+
+// ScheduleNames returns the names of the configured backup schedules
+func (cfg *Config) ScheduleNames() (names []string) {
+	for _, s := range cfg.Schedules() {
+		names = append(names, s.Name)
+	}
+	return
+}
+
+// ExpirationDays returns the retention (in days) of a given schedule (or 0 if not defined)
+func (cfg *Config) ExpirationDays(schedule string) int64 {
+	if days := cfg.Expiration.Days(schedule); days > 0 {
+		return days
+	}
+	for _, s := range cfg.Schedules() {
+		if s.Name == schedule {
+			return s.Expiration
+		}
+	}
+	return 0
+}
+
+// UseClient applies the settings of the most specific [client."pattern"] section matching a client (if any)
+func (cfg *Config) UseClient(name string) bool {
+	pattern, found := "", false
+	for p := range cfg.Clients {
+		if ok, _ := path.Match(p, name); !ok || pattern == name {
+			continue
+		}
+		if !found || p == name || len(p) > len(pattern) || (len(p) == len(pattern) && p < pattern) {
+			pattern, found = p, true
+		}
+	}
+	if !found {
+		return false
+	}
+	c := cfg.Clients[pattern]
+
+	if c.Expiration.Daily != 0 {
+		cfg.Expiration.Daily = c.Expiration.Daily
+	}
+	if c.Expiration.Weekly != 0 {
+		cfg.Expiration.Weekly = c.Expiration.Weekly
+	}
+	if c.Expiration.Monthly != 0 {
+		cfg.Expiration.Monthly = c.Expiration.Monthly
+	}
+	if c.Expiration.Yearly != 0 {
+		cfg.Expiration.Yearly = c.Expiration.Yearly
+	}
+	if c.Expiration.Failed != 0 {
+		cfg.Expiration.Failed = c.Expiration.Failed
+	}
+	if c.Retention.Enabled() {
+		cfg.Retention = c.Retention
+	}
+	if c.Interval != "" {
+		cfg.Interval = c.Interval
+		cfg.interval, _ = parseinterval(c.Interval)
+	}
+	if c.Keep != 0 {
+		cfg.Keep = c.Keep
+	}
+	cfg.quota, _ = ParseBytes(c.Quota)
+	cfg.allowed = c.Schedules
+
+	return true
+}
+
+// Allowed checks whether backups can use a given schedule
+func (cfg *Config) Allowed(schedule string) bool {
+	if len(cfg.allowed) == 0 {
+		return true
+	}
+	for _, s := range cfg.allowed {
+		if s == schedule {
+			return true
+		}
+	}
+	return false
+}
+
+// ProfileName returns the backup name used by a named profile
+func (cfg *Config) ProfileName(p string) string {
+	if profile, ok := cfg.Profile[p]; ok && profile.Name != "" {
+		return profile.Name
+	}
+	return defaultName + "-" + p
+}
+
 // IsServer returns true is we are on a server
 func (cfg *Config) IsServer() bool {
 	return len(cfg.Server) < 1
@@ -90,16 +386,16 @@ func (cfg *Config) IsServer() bool {
 // ServerOnly ensures we are on a server (or aborts)
 func (cfg *Config) ServerOnly() {
 	if !cfg.IsServer() {
-		fmt.Println("This command can only be used on a", programName, "server.")
-		log.Fatal("Server-only command issued on a client.")
+		fmt.Fprintln(cmdout, "This command can only be used on a", programName, "server.")
+		fatal("Server-only command issued on a client.")
 	}
 }
 
 // ClientOnly ensures we are on a client (or aborts)
 func (cfg *Config) ClientOnly() {
 	if cfg.IsServer() {
-		fmt.Println("This command can only be used on a", programName, "client.")
-		log.Fatal("Client-only command issued on a server.")
+		fmt.Fprintln(cmdout, "This command can only be used on a", programName, "client.")
+		fatal("Client-only command issued on a server.")
 	}
 }
 
@@ -110,8 +406,43 @@ func Setup() {
 	cfg.Load(configFile)
 	Debug(cfg.Debug)
 
+	if len(cfg.Schedule) > 0 { // custom schedules: backups start with the shortest one and get promoted
+		if schedule == defaultSchedule {
+			schedule = cfg.Schedule[0].Name
+		}
+		defaultSchedule = cfg.Schedule[0].Name
+	}
+
+	if profile != "" {
+		if err := cfg.UseProfile(profile); err != nil {
+			fmt.Fprintln(cmderr, err)
+			fatal(err)
+		}
+		if name == defaultName {
+			name = cfg.ProfileName(profile)
+		}
+		defaultName = cfg.ProfileName(profile)
+		if s := cfg.Profile[profile].Schedule; s != "" {
+			if schedule == defaultSchedule {
+				schedule = s
+			}
+			defaultSchedule = s
+		}
+	}
+
+	if isvault() {
+		cfg.Exclude = append(cfg.Exclude, vaultpath())
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "protocol" || f.Name == "p" {
+			negotiated = true // explicitly requested protocol version
+		}
+	})
+
 	if protocol > protocolVersion {
-		fmt.Fprintln(os.Stderr, "Unsupported protocol")
-		log.Fatalf("Protocol error (supported=%d requested=%d)", protocolVersion, protocol)
+		fmt.Fprintln(cmderr, "Unsupported protocol")
+		fatalf("Protocol error (supported=%d requested=%d)", protocolVersion, protocol)
 	}
+
+	compressstdio()
 }
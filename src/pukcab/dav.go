@@ -1,17 +1,14 @@
 package main
 
 import (
-	"encoding/gob"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"syscall"
 	"time"
 
 	"pukcab/tar"
@@ -69,9 +66,8 @@ func listbackups(name string) (*BackupsReport, error) {
 
 		switch hdr.Typeflag {
 		case tar.TypeXGlobalHeader:
-			var header BackupInfo
-			dec := gob.NewDecoder(tr)
-			if err := dec.Decode(&header); err != nil {
+			header, err := ReadBackupInfo(tr)
+			if err != nil {
 				log.Println(err)
 				return nil, err
 			} else {
@@ -92,14 +88,7 @@ func listbackups(name string) (*BackupsReport, error) {
 	}
 
 	if err := cmd.Wait(); err != nil {
-		if exiterr, ok := err.(*exec.ExitError); ok {
-			// The program has exited with an exit code != 0
-			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-				if status.ExitStatus() != 2 {
-					log.Println(cmd.Args, err)
-				}
-			}
-		} else {
+		if exitstatus(err) != 2 { // the program hasn't exited with "busy" status
 			log.Println(cmd.Args, err)
 		}
 
@@ -139,9 +128,8 @@ func listfiles(date BackupID, path string) (*FilesReport, error) {
 
 		switch hdr.Typeflag {
 		case tar.TypeXGlobalHeader:
-			var header BackupInfo
-			dec := gob.NewDecoder(tr)
-			if err := dec.Decode(&header); err != nil {
+			header, err := ReadBackupInfo(tr)
+			if err != nil {
 				log.Println(err)
 				return nil, err
 			} else {
@@ -169,14 +157,7 @@ func listfiles(date BackupID, path string) (*FilesReport, error) {
 	}
 
 	if err := cmd.Wait(); err != nil {
-		if exiterr, ok := err.(*exec.ExitError); ok {
-			// The program has exited with an exit code != 0
-			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-				if status.ExitStatus() != 2 {
-					log.Println(cmd.Args, err)
-				}
-			}
-		} else {
+		if exitstatus(err) != 2 { // the program hasn't exited with "busy" status
 			log.Println(cmd.Args, err)
 		}
 
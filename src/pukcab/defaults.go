@@ -16,8 +16,14 @@ const defaultCatalog = "catalog.db"
 const defaultVault = "vault"
 const defaultMaxtries = 10
 const defaultTimeout = 6 * 3600 // 6 hours
+const defaultFailed = 7         // days
 
-const protocolVersion = 1
+const defaultConnectTimeout = 30 // seconds
+const defaultKeepalive = 60      // seconds
+
+const protocolVersion = 2
+
+const exitSkipped = 3 // the server refused a new backup (too soon after the previous one)
 
 var programFile = "backup"
 var defaultName = "backup"
@@ -4,3 +4,4 @@ const gzipOS = 3 // UNIX, cf. http://www.gzip.org/zlib/rfc-gzip.html
 
 const defaultConfig = "/etc/pukcab.conf"
 const defaultUserConfig = ".pukcabrc"
+const defaultCache = "/var/lib/pukcab"
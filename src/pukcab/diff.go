@@ -0,0 +1,198 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"pukcab/tar"
+)
+
+// kinds of differences between two backup sets
+const (
+	diffAdded    = "added"
+	diffRemoved  = "removed"
+	diffModified = "modified"
+	diffMetadata = "metadata"
+)
+
+// Difference describes how an entry changed between two backup sets
+type Difference struct {
+	Path   string   `json:"path"`
+	Change string   `json:"change"`
+	Fields []string `json:"fields,omitempty"`
+	Size   int64    `json:"size,omitempty"`
+}
+
+// Diff records the differences between two backup sets
+type Diff struct {
+	FromName    string       `json:"fromname"`
+	From        BackupID     `json:"from"`
+	ToName      string       `json:"toname"`
+	To          BackupID     `json:"to"`
+	Added       int          `json:"added"`
+	Removed     int          `json:"removed"`
+	Modified    int          `json:"modified"`
+	Metadata    int          `json:"metadata"`
+	Differences []Difference `json:"differences"`
+}
+
+// snapshot retrieves the metadata of all the entries of a backup set
+func snapshot(name string, date BackupID, files ...string) (BackupID, map[string]tar.Header, error) {
+	found := BackupID(0)
+	entries := make(map[string]tar.Header)
+
+	err := process("metadata", &Backup{Name: name, Date: date}, func(hdr tar.Header) {
+		switch hdr.Typeflag {
+		case tar.TypeXGlobalHeader:
+			found = BackupID(hdr.ModTime.Unix())
+		case '?':
+		default:
+			p := path.Join("/", hdr.Name)
+			if len(files) == 0 || contains(files, p) {
+				entries[p] = hdr
+			}
+		}
+	})
+	return found, entries, err
+}
+
+// changes lists the metadata fields which differ between two versions of an entry
+func changes(a, b tar.Header) (fields []string) {
+	if a.Typeflag != b.Typeflag {
+		fields = append(fields, "type")
+	}
+	if a.Mode != b.Mode {
+		fields = append(fields, "mode")
+	}
+	if a.Uid != b.Uid || a.Uname != b.Uname {
+		fields = append(fields, "owner")
+	}
+	if a.Gid != b.Gid || a.Gname != b.Gname {
+		fields = append(fields, "group")
+	}
+	if a.ModTime.Unix() != b.ModTime.Unix() {
+		fields = append(fields, "modified")
+	}
+	if a.Typeflag == tar.TypeSymlink && b.Typeflag == tar.TypeSymlink && a.Linkname != b.Linkname {
+		fields = append(fields, "target")
+	}
+	if a.Devmajor != b.Devmajor || a.Devminor != b.Devminor {
+		fields = append(fields, "device")
+	}
+	return
+}
+
+// diffbackups compares a backup set of name (by default the one preceding to) with a backup set of with
+// and reports entries that were added, removed, whose contents changed (different hash or size) or
+// whose metadata changed
+func diffbackups(name string, from BackupID, with string, to BackupID, files ...string) (*Diff, error) {
+	if with == "" {
+		with = name
+	}
+	d := &Diff{FromName: name, ToName: with}
+
+	var err error
+	var before, after map[string]tar.Header
+	if d.To, after, err = snapshot(with, to, files...); err != nil || d.To == 0 {
+		return d, err
+	}
+	if from == 0 {
+		if with == name {
+			from = d.To - 1
+		} else {
+			from = to
+		}
+	}
+	if d.From, before, err = snapshot(name, from, files...); err != nil || d.From == 0 {
+		return d, err
+	}
+
+	for p, a := range before {
+		b, ok := after[p]
+		switch {
+		case !ok:
+			d.Differences = append(d.Differences, Difference{Path: p, Change: diffRemoved, Size: a.Size})
+			d.Removed++
+		case a.Typeflag == tar.TypeReg && b.Typeflag == tar.TypeReg && (a.Size != b.Size || a.Xattrs["backup.hash"] != b.Xattrs["backup.hash"]):
+			d.Differences = append(d.Differences, Difference{Path: p, Change: diffModified, Fields: changes(a, b), Size: b.Size})
+			d.Modified++
+		default:
+			if fields := changes(a, b); len(fields) > 0 {
+				d.Differences = append(d.Differences, Difference{Path: p, Change: diffMetadata, Fields: fields, Size: b.Size})
+				d.Metadata++
+			}
+		}
+	}
+	for p, b := range after {
+		if _, ok := before[p]; !ok {
+			d.Differences = append(d.Differences, Difference{Path: p, Change: diffAdded, Size: b.Size})
+			d.Added++
+		}
+	}
+
+	sort.Slice(d.Differences, func(i, j int) bool {
+		return d.Differences[i].Path < d.Differences[j].Path
+	})
+
+	return d, nil
+}
+
+func printdiff(d *Diff) {
+	fmt.Println("From:    ", d.FromName, d.From, "(", d.From.Time(), ")")
+	fmt.Println("To:      ", d.ToName, d.To, "(", d.To.Time(), ")")
+	for _, e := range d.Differences {
+		switch e.Change {
+		case diffAdded:
+			fmt.Printf("+ %s\n", e.Path)
+		case diffRemoved:
+			fmt.Printf("- %s\n", e.Path)
+		case diffModified:
+			fmt.Printf("M %s\n", e.Path)
+		case diffMetadata:
+			fmt.Printf("m %s (%s)\n", e.Path, strings.Join(e.Fields, ", "))
+		}
+	}
+	fmt.Println("Added:   ", d.Added)
+	fmt.Println("Removed: ", d.Removed)
+	fmt.Println("Modified:", d.Modified)
+	fmt.Println("Metadata:", d.Metadata)
+}
+
+func diff() {
+	from, to := BackupID(0), BackupID(0)
+	with := ""
+	jsonoutput := false
+	to.Set("now")
+
+	flag.StringVar(&name, "name", defaultName, "Backup name")
+	flag.StringVar(&name, "n", defaultName, "-name")
+	flag.Var(&from, "from", "Backup set to compare (by default, the one preceding -to)")
+	flag.Var(&to, "to", "Backup set to compare with")
+	flag.StringVar(&with, "with", with, "Backup name of the -to backup set (to compare different systems)")
+	flag.BoolVar(&jsonoutput, "json", jsonoutput, "JSON output")
+
+	Setup()
+
+	if name == "" {
+		failure.Fatal("Missing backup name")
+	}
+
+	d, err := diffbackups(name, from, with, to, flag.Args()...)
+	if err != nil {
+		failure.Println(err)
+		log.Fatal(err)
+	}
+	if d.From == 0 || d.To == 0 {
+		failure.Fatal("Backup not found")
+	}
+
+	if jsonoutput {
+		fmt.Print(JSON(d))
+	} else {
+		printdiff(d)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"pukcab/tar"
+)
+
+func TestChanges(t *testing.T) {
+	modified := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	file := tar.Header{
+		Name:     "etc/passwd",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Uid:      0,
+		Uname:    "root",
+		Gid:      0,
+		Gname:    "root",
+		ModTime:  modified,
+		Size:     2048,
+	}
+	link := tar.Header{
+		Name:     "etc/localtime",
+		Typeflag: tar.TypeSymlink,
+		Mode:     0777,
+		Linkname: "/usr/share/zoneinfo/UTC",
+		ModTime:  modified,
+	}
+	device := tar.Header{
+		Name:     "dev/null",
+		Typeflag: tar.TypeChar,
+		Mode:     0666,
+		Devmajor: 1,
+		Devminor: 3,
+		ModTime:  modified,
+	}
+
+	tests := []struct {
+		name   string
+		before tar.Header
+		change func(*tar.Header)
+		fields []string
+	}{
+		{"unchanged", file, func(h *tar.Header) {}, nil},
+		{"contents only", file, func(h *tar.Header) { h.Size = 4096 }, nil},
+		{"sub-second time", file, func(h *tar.Header) { h.ModTime = modified.Add(time.Millisecond) }, nil},
+		{"type", file, func(h *tar.Header) { h.Typeflag = tar.TypeDir }, []string{"type"}},
+		{"mode", file, func(h *tar.Header) { h.Mode = 0600 }, []string{"mode"}},
+		{"uid", file, func(h *tar.Header) { h.Uid = 1000 }, []string{"owner"}},
+		{"user name", file, func(h *tar.Header) { h.Uname = "admin" }, []string{"owner"}},
+		{"gid", file, func(h *tar.Header) { h.Gid = 1000 }, []string{"group"}},
+		{"group name", file, func(h *tar.Header) { h.Gname = "wheel" }, []string{"group"}},
+		{"time", file, func(h *tar.Header) { h.ModTime = modified.Add(time.Hour) }, []string{"modified"}},
+		{"link target", link, func(h *tar.Header) { h.Linkname = "/usr/share/zoneinfo/CET" }, []string{"target"}},
+		{"not a link", file, func(h *tar.Header) { h.Linkname = "ignored" }, nil},
+		{"device", device, func(h *tar.Header) { h.Devminor = 5 }, []string{"device"}},
+		{"several", file, func(h *tar.Header) {
+			h.Mode = 0600
+			h.Uid = 1000
+			h.ModTime = modified.Add(time.Hour)
+		}, []string{"mode", "owner", "modified"}},
+	}
+
+	for _, test := range tests {
+		after := test.before
+		test.change(&after)
+		if fields := changes(test.before, after); !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("%s: changes = %q, expected %q", test.name, fields, test.fields)
+		}
+	}
+}
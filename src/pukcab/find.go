@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"pukcab/tar"
+)
+
+// Finder holds search criteria for backup entries
+type Finder struct {
+	Patterns         []string
+	Regexp           *regexp.Regexp
+	MinSize, MaxSize int64
+	Newer, Older     BackupID
+	Owner            string
+	Type             string
+	Hash             string
+}
+
+// types of entries, as used by find(1)
+var findtypes = map[string]byte{
+	"f": tar.TypeReg,
+	"d": tar.TypeDir,
+	"l": tar.TypeSymlink,
+	"b": tar.TypeBlock,
+	"c": tar.TypeChar,
+	"p": tar.TypeFifo,
+}
+
+// Match checks whether an entry matches all the criteria
+func (f *Finder) Match(hdr tar.Header) bool {
+	p := path.Join("/", hdr.Name)
+
+	if len(f.Patterns) > 0 {
+		matched := false
+		for _, pattern := range f.Patterns {
+			subject := p
+			if !strings.Contains(pattern, "/") {
+				subject = path.Base(p)
+			}
+			if m, _ := filepath.Match(pattern, subject); m {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if f.Regexp != nil && !f.Regexp.MatchString(p) {
+		return false
+	}
+	if f.Type != "" && hdr.Typeflag != findtypes[f.Type] {
+		return false
+	}
+	if f.MinSize > 0 && hdr.Size < f.MinSize {
+		return false
+	}
+	if f.MaxSize > 0 && hdr.Size > f.MaxSize {
+		return false
+	}
+	if f.Newer != 0 && hdr.ModTime.Unix() < int64(f.Newer) {
+		return false
+	}
+	if f.Older != 0 && hdr.ModTime.Unix() > int64(f.Older) {
+		return false
+	}
+	if f.Owner != "" && hdr.Uname != f.Owner && strconv.Itoa(hdr.Uid) != f.Owner {
+		return false
+	}
+	if f.Hash != "" && hdr.Xattrs["backup.hash"] != f.Hash {
+		return false
+	}
+	return true
+}
+
+// find goes through the timeline of one or all clients and lists the entries matching all the criteria
+func find() {
+	var finder Finder
+	var from, to BackupID
+	regex := ""
+	minsize, maxsize := "", ""
+
+	flag.StringVar(&name, "name", "", "Backup name (all by default)")
+	flag.StringVar(&name, "n", "", "-name")
+	flag.Var(&from, "from", "Only search backups taken since this date")
+	flag.Var(&to, "to", "Only search backups taken until this date")
+	flag.StringVar(&regex, "regex", regex, "Regular expression to match on full paths")
+	flag.StringVar(&minsize, "minsize", minsize, "Minimum file size")
+	flag.StringVar(&maxsize, "maxsize", maxsize, "Maximum file size")
+	flag.Var(&finder.Newer, "newer", "Only files modified since this date")
+	flag.Var(&finder.Older, "older", "Only files modified until this date")
+	flag.StringVar(&finder.Owner, "owner", "", "Owner (user name or uid)")
+	flag.StringVar(&finder.Type, "type", "", "Type of entry (f, d, l, b, c or p)")
+	flag.StringVar(&finder.Hash, "hash", "", "Contents hash (or local file with the same contents)")
+
+	Setup()
+
+	if name == "*" {
+		name = ""
+	}
+
+	finder.Patterns = flag.Args()
+	if regex != "" {
+		r, err := regexp.Compile(regex)
+		if err != nil {
+			failure.Fatal("Invalid regular expression: ", err)
+		}
+		finder.Regexp = r
+	}
+	if minsize != "" {
+		s, err := ParseBytes(minsize)
+		if err != nil {
+			failure.Fatal("Invalid size: ", minsize)
+		}
+		finder.MinSize = s
+	}
+	if maxsize != "" {
+		s, err := ParseBytes(maxsize)
+		if err != nil {
+			failure.Fatal("Invalid size: ", maxsize)
+		}
+		finder.MaxSize = s
+	}
+	if _, ok := findtypes[finder.Type]; finder.Type != "" && !ok {
+		failure.Fatal("Invalid type: ", finder.Type)
+	}
+	if finder.Hash != "" && Exists(finder.Hash) {
+		_, finder.Hash = Hash(finder.Hash)
+	}
+
+	var current BackupID
+	var backupname string
+	found := 0
+	if err := process("timeline", &Backup{Name: name, Date: from}, func(hdr tar.Header) {
+		switch hdr.Typeflag {
+		case tar.TypeXGlobalHeader:
+			current, backupname = BackupID(hdr.ModTime.Unix()), hdr.Name
+		case '?':
+		default:
+			if to != 0 && current > to {
+				return
+			}
+			if finder.Match(hdr) {
+				found++
+				fmt.Printf("%s\t%d\t%s\t%d\t%s\n", backupname, current, path.Join("/", hdr.Name), hdr.Size, hdr.Xattrs["backup.hash"])
+			}
+		}
+	}); err != nil {
+		failure.Println(err)
+		log.Fatal(err)
+	}
+
+	if found == 0 {
+		failure.Fatal("Not found")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"pukcab/tar"
+)
+
+func TestFinderMatch(t *testing.T) {
+	modified := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	passwd := tar.Header{
+		Name:     "etc/passwd",
+		Typeflag: tar.TypeReg,
+		Size:     2048,
+		ModTime:  modified,
+		Uid:      0,
+		Uname:    "root",
+		Xattrs:   map[string]string{"backup.hash": "abc123"},
+	}
+	etc := tar.Header{
+		Name:     "/etc",
+		Typeflag: tar.TypeDir,
+		ModTime:  modified,
+		Uid:      0,
+		Uname:    "root",
+	}
+	since := BackupID(modified.Unix())
+
+	tests := []struct {
+		finder  Finder
+		hdr     tar.Header
+		matches bool
+	}{
+		{Finder{}, passwd, true},
+		{Finder{Patterns: []string{"passwd"}}, passwd, true},
+		{Finder{Patterns: []string{"pass*"}}, passwd, true},
+		{Finder{Patterns: []string{"*.conf"}}, passwd, false},
+		{Finder{Patterns: []string{"*.conf", "passwd"}}, passwd, true},
+		{Finder{Patterns: []string{"/etc/*"}}, passwd, true},
+		{Finder{Patterns: []string{"etc/*"}}, passwd, false}, // full paths start with /
+		{Finder{Patterns: []string{"/*"}}, passwd, false},
+		{Finder{Regexp: regexp.MustCompile("^/etc/")}, passwd, true},
+		{Finder{Regexp: regexp.MustCompile("^/var/")}, passwd, false},
+		{Finder{Type: "f"}, passwd, true},
+		{Finder{Type: "d"}, passwd, false},
+		{Finder{Type: "d"}, etc, true},
+		{Finder{MinSize: 1024}, passwd, true},
+		{Finder{MinSize: 4096}, passwd, false},
+		{Finder{MaxSize: 4096}, passwd, true},
+		{Finder{MaxSize: 1024}, passwd, false},
+		{Finder{Newer: since}, passwd, true},
+		{Finder{Newer: since + 1}, passwd, false},
+		{Finder{Older: since}, passwd, true},
+		{Finder{Older: since - 1}, passwd, false},
+		{Finder{Owner: "root"}, passwd, true},
+		{Finder{Owner: "0"}, passwd, true},
+		{Finder{Owner: "nobody"}, passwd, false},
+		{Finder{Hash: "abc123"}, passwd, true},
+		{Finder{Hash: "def456"}, passwd, false},
+		{Finder{Hash: "abc123"}, etc, false},
+		{Finder{Patterns: []string{"passwd"}, Type: "f", Owner: "root", MaxSize: 4096}, passwd, true},
+		{Finder{Patterns: []string{"passwd"}, Type: "f", Owner: "nobody"}, passwd, false},
+	}
+
+	for _, test := range tests {
+		if matches := test.finder.Match(test.hdr); matches != test.matches {
+			t.Errorf("%+v.Match(%q) = %v, expected %v", test.finder, test.hdr.Name, matches, test.matches)
+		}
+	}
+}
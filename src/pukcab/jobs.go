@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// job states
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+	jobSkipped   = "skipped"
+)
+
+const maxJobOutput = 1000 // lines
+
+// commands that can be run as jobs
+var jobcommands = map[string]bool{
+	"backup":  true,
+	"resume":  true,
+	"verify":  true,
+	"restore": true,
+}
+
+// Job is a command queued by the server for a client running "pukcab auto"
+type Job struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Command  string    `json:"command"`
+	Args     []string  `json:"args,omitempty"`
+	State    string    `json:"state"`
+	Queued   time.Time `json:"queued"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Status   int       `json:"status"`
+	Output   []string  `json:"output,omitempty"`
+}
+
+// checkjob makes sure a job can be run by a client (local checks also look at the client's file system)
+func checkjob(command string, args []string, local bool) ([]string, error) {
+	if !jobcommands[command] {
+		return nil, fmt.Errorf("Command %q cannot be run as a job", command)
+	}
+
+	result := []string{}
+	directory := ""
+	for i := 0; i < len(args); i++ {
+		if match, value := isflag(args[i], "name", "n", "config", "c", "profile", "P"); match {
+			if !value {
+				i++ // skip flag value
+			}
+			continue
+		}
+		if match, _ := isflag(args[i], "in-place", "inplace"); match {
+			return nil, errors.New("In-place restore cannot be run as a job")
+		}
+		if match, value := isflag(args[i], "directory", "C"); match {
+			if value {
+				directory = args[i][strings.IndexByte(args[i], '=')+1:]
+			} else if i+1 < len(args) {
+				result = append(result, args[i])
+				i++
+				directory = args[i]
+			}
+			if err := checkrestore(directory, local); err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, args[i])
+	}
+	if command == "restore" && directory == "" {
+		return nil, errors.New("Missing restore directory")
+	}
+
+	return result, nil
+}
+
+// checkrestore makes sure a job doesn't restore files over existing ones: the directory must be
+// under the client's restore root, or not exist yet, or be empty
+func checkrestore(directory string, local bool) error {
+	if directory == "" || !filepath.IsAbs(directory) {
+		return fmt.Errorf("Restore directory %q must be an absolute path", directory)
+	}
+	directory = filepath.Clean(directory)
+	if directory == string(filepath.Separator) {
+		return errors.New("Jobs cannot restore files to the root directory")
+	}
+	if !local {
+		return nil
+	}
+
+	if cfg.Restore != "" {
+		if root := filepath.Clean(cfg.Restore); strings.HasPrefix(directory, root+string(filepath.Separator)) {
+			return nil
+		}
+	}
+	if entries, err := ioutil.ReadDir(directory); err == nil && len(entries) > 0 {
+		return fmt.Errorf("Restore directory %q is not empty", directory)
+	}
+	return nil
+}
+
+// jobsdir is where jobs are stored (one JSON file per job, plus a log of its output)
+func jobsdir() string {
+	return filepath.Join(cfg.Vault, "jobs")
+}
+
+func joblog(id string) string {
+	return filepath.Join(jobsdir(), id+".log")
+}
+
+// lockjobs prevents concurrent changes to the job queue
+func lockjobs() (*os.File, error) {
+	if err := os.MkdirAll(jobsdir(), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(jobsdir(), ".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func unlockjobs(f *os.File) {
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	f.Close()
+}
+
+func loadjob(id string) (job Job, err error) {
+	if id == "" || strings.ContainsAny(id, "/.") {
+		return job, fmt.Errorf("Invalid job %q", id)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(jobsdir(), id+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = fmt.Errorf("Unknown job %q", id)
+		}
+		return
+	}
+	if err = json.Unmarshal(data, &job); err != nil {
+		return
+	}
+	if output, err := ioutil.ReadFile(joblog(id)); err == nil && len(output) > 0 {
+		job.Output = strings.Split(strings.TrimSuffix(string(output), "\n"), "\n")
+		if len(job.Output) > maxJobOutput {
+			job.Output = job.Output[len(job.Output)-maxJobOutput:]
+		}
+	}
+	return
+}
+
+// savejob records the state of a job (its output is only ever appended to its log, see appendjob)
+func savejob(job Job) error {
+	job.Output = nil
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(jobsdir(), "."+job.ID+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(jobsdir(), job.ID+".json"))
+}
+
+// appendjob adds lines to the output of a job
+func appendjob(id string, lines ...string) error {
+	f, err := os.OpenFile(joblog(id), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		fmt.Fprintln(f, line)
+	}
+	return f.Close()
+}
+
+// Jobs returns all the jobs for a given client (or all clients if name is empty), oldest first
+func Jobs(name string) (jobs []Job) {
+	files, _ := filepath.Glob(filepath.Join(jobsdir(), "*.json"))
+	for _, f := range files {
+		if job, err := loadjob(strings.TrimSuffix(filepath.Base(f), ".json")); err == nil {
+			if name == "" || job.Name == name {
+				jobs = append(jobs, job)
+			}
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Queued.Before(jobs[j].Queued) })
+	return
+}
+
+// updatejob applies a change to a job while the queue is locked
+func updatejob(id string, update func(*Job) error) (job Job, err error) {
+	lock, err := lockjobs()
+	if err != nil {
+		return
+	}
+	defer unlockjobs(lock)
+
+	if job, err = loadjob(id); err != nil {
+		return
+	}
+	if err = update(&job); err != nil {
+		return
+	}
+	err = savejob(job)
+	return
+}
+
+func printjob(job Job) {
+	status := ""
+	if job.State == jobDone || job.State == jobFailed {
+		status = fmt.Sprintf("(%d)", job.Status)
+	}
+	fmt.Fprintf(cmdout, "%-20s %-20s %-9s %-10s %s %s\n", job.ID, job.Name, job.State+status, job.Command, DisplayTime(job.Queued), strings.Join(job.Args, " "))
+	if verbose {
+		for _, line := range job.Output {
+			fmt.Fprintln(cmdout, "    ", line)
+		}
+	}
+}
+
+func jobs() {
+	queue := ""
+	cancel := ""
+	jsonoutput := false
+	flag.StringVar(&name, "name", "", "Backup name")
+	flag.StringVar(&name, "n", "", "-name")
+	flag.StringVar(&queue, "queue", queue, "Queue a job (backup, resume, verify or restore)")
+	flag.StringVar(&queue, "q", queue, "-queue")
+	flag.StringVar(&cancel, "cancel", cancel, "Cancel a queued job")
+	flag.BoolVar(&jsonoutput, "json", jsonoutput, "JSON output")
+
+	SetupServer()
+	cfg.ServerOnly()
+
+	switch {
+	case queue != "":
+		if name == "" {
+			failure.Fatal("Missing backup name")
+		}
+		args, err := checkjob(queue, flag.Args(), false)
+		if err != nil {
+			failure.Fatal(err)
+		}
+
+		lock, err := lockjobs()
+		if err != nil {
+			LogExit(err)
+		}
+		job := Job{
+			ID:      strconv.FormatInt(time.Now().UnixNano(), 10),
+			Name:    name,
+			Command: queue,
+			Args:    args,
+			State:   jobQueued,
+			Queued:  time.Now(),
+		}
+		err = savejob(job)
+		unlockjobs(lock)
+		if err != nil {
+			LogExit(err)
+		}
+		log.Printf("Queued job: id=%q name=%q command=%q\n", job.ID, job.Name, strings.Join(append([]string{job.Command}, job.Args...), " "))
+		fmt.Fprintln(cmdout, job.ID)
+
+	case cancel != "":
+		job, err := updatejob(cancel, func(job *Job) error {
+			if job.State != jobQueued {
+				return fmt.Errorf("Job %q is %s", job.ID, job.State)
+			}
+			job.State = jobCancelled
+			job.Finished = time.Now()
+			return nil
+		})
+		if err != nil {
+			failure.Fatal(err)
+		}
+		log.Printf("Cancelled job: id=%q name=%q\n", job.ID, job.Name)
+
+	default:
+		for _, job := range Jobs(name) {
+			if jsonoutput {
+				fmt.Fprint(cmdout, JSON(job))
+			} else {
+				printjob(job)
+			}
+		}
+	}
+}
+
+// nextjob waits for a job for a client and marks it as running (the client then streams the
+// job's output back with jobstatus)
+func nextjob() {
+	wait := 60
+	flag.StringVar(&name, "name", "", "Backup name")
+	flag.StringVar(&name, "n", "", "-name")
+	flag.IntVar(&wait, "wait", wait, "Maximum time to wait for a job (in seconds)")
+
+	SetupServer()
+	cfg.ServerOnly()
+
+	if name == "" {
+		failure.Println("Missing backup name")
+		fatal("Client did not provide a backup name")
+	}
+
+	interrupted := true // jobs still running when the client asks for a new one were interrupted
+	deadline := time.Now().Add(time.Duration(wait) * time.Second)
+	for {
+		lock, err := lockjobs()
+		if err != nil {
+			LogExit(err)
+		}
+		for _, job := range Jobs(name) {
+			switch {
+			case job.State == jobRunning && interrupted:
+				job.State, job.Status, job.Finished = jobFailed, -1, time.Now()
+				savejob(job)
+				appendjob(job.ID, "Interrupted")
+				log.Printf("Interrupted job: id=%q name=%q error=warn\n", job.ID, job.Name)
+			case job.State == jobQueued:
+				job.State, job.Started = jobRunning, time.Now()
+				err := savejob(job)
+				unlockjobs(lock)
+				if err != nil {
+					LogExit(err)
+				}
+				log.Printf("Started job: id=%q name=%q command=%q\n", job.ID, job.Name, job.Command)
+				job.Output = nil
+				fmt.Fprint(cmdout, JSON(job))
+				return
+			}
+		}
+		unlockjobs(lock)
+		interrupted = false
+
+		if time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// jobstatus records the output of a running job (read from stdin and appended to its log) or its exit status
+func jobstatus() {
+	id := ""
+	status := -1
+	flag.StringVar(&name, "name", "", "Backup name")
+	flag.StringVar(&name, "n", "", "-name")
+	flag.StringVar(&id, "id", id, "Job ID")
+	flag.IntVar(&status, "exit", status, "Exit status of the job")
+
+	SetupServer()
+	cfg.ServerOnly()
+
+	if name == "" {
+		failure.Println("Missing backup name")
+		fatal("Client did not provide a backup name")
+	}
+
+	running := func(job *Job) error {
+		if job.Name != name || job.State != jobRunning {
+			return fmt.Errorf("Job %q is not running for %s", id, name)
+		}
+		return nil
+	}
+
+	if status >= 0 {
+		if _, err := updatejob(id, func(job *Job) error {
+			if err := running(job); err != nil {
+				return err
+			}
+			job.State, job.Status, job.Finished = jobDone, status, time.Now()
+			switch status {
+			case 0:
+			case exitSkipped:
+				job.State = jobSkipped
+			default:
+				job.State = jobFailed
+			}
+			return nil
+		}); err != nil {
+			failure.Println(err)
+			fatal(err)
+		}
+		log.Printf("Finished job: id=%q name=%q status=%d\n", id, name, status)
+		return
+	}
+
+	job, err := loadjob(id)
+	if err == nil {
+		err = running(&job)
+	}
+	if err != nil {
+		failure.Println(err)
+		fatal(err)
+	}
+	output, err := os.OpenFile(joblog(id), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		LogExit(err)
+	}
+	defer output.Close()
+
+	scanner := bufio.NewScanner(cmdin)
+	for scanner.Scan() {
+		fmt.Fprintln(output, scanner.Text())
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"log/syslog"
 	"os"
+	"strings"
 )
 
 const debugFlags = log.Lshortfile
@@ -15,9 +17,18 @@ var debug = log.New(ioutil.Discard, "", 0)
 var info = log.New(ioutil.Discard, "", 0)
 var failure = log.New(os.Stderr, failPrefix, 0)
 
+// exit terminates the program (within a session, only the current command)
+var exit = os.Exit
+
+// standard streams of server commands (pipes to the caller when a command runs in-process)
+var cmdin, cmdout, cmderr = os.Stdin, os.Stdout, os.Stderr
+
 // Debug enables (or disables) debug logging
 func Debug(on bool) {
 	if on {
+		if debug.Prefix() == debugPrefix { // already enabled
+			return
+		}
 		arg0 := os.Args[0]
 		os.Args[0] = programFile
 		defer func() { os.Args[0] = arg0 }()
@@ -43,7 +54,7 @@ func Info(on bool) {
 // Failure enables (or disables) error logging
 func Failure(on bool) {
 	if on {
-		failure = log.New(os.Stderr, failPrefix, 0)
+		failure = log.New(cmderr, failPrefix, 0)
 	} else {
 		failure = log.New(ioutil.Discard, "", 0)
 	}
@@ -63,16 +74,37 @@ func NewLogStream(logger *log.Logger) (stream *LogStream) {
 }
 
 func (l *LogStream) Write(p []byte) (n int, err error) {
-	l.Printf("%s", p)
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		if frame, ok := ParseErrorFrame(strings.TrimSpace(line)); ok {
+			if frame.Code != 0 {
+				log.Printf("Remote error: command=%q code=%d msg=%q\n", frame.Command, frame.Code, frame.Error)
+			}
+			l.Println(frame.Error)
+		} else if line != "" {
+			l.Printf("%s", line)
+		}
+	}
 	return len(p), nil
 }
 
 // LogExit logs an error and exits (returning 2 for EBUSY and 1 otherwise)
 func LogExit(err error) {
 	if busy(err) {
-		os.Exit(2)
+		exit(2)
 	} else {
 		log.Printf("Exiting: name=%q date=%d msg=%q error=fatal\n", name, date, err)
-		os.Exit(1)
+		exit(1)
 	}
 }
+
+// fatal logs a message and exits (like log.Fatal)
+func fatal(v ...interface{}) {
+	log.Output(2, fmt.Sprint(v...))
+	exit(1)
+}
+
+// fatalf logs a formatted message and exits (like log.Fatalf)
+func fatalf(format string, v ...interface{}) {
+	log.Output(2, fmt.Sprintf(format, v...))
+	exit(1)
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 
 	"github.com/lyonel/go-sqlite3"
@@ -17,6 +18,10 @@ var name = ""
 var date BackupID = -1
 var schedule = ""
 var full = false
+var label = ""
+var comment = ""
+var profile = ""
+var localvault = ""
 
 type boolFlag interface {
 	flag.Value
@@ -26,6 +31,9 @@ type boolFlag interface {
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage: %s %s [options]\n\nOptions:\n", programName, os.Args[0])
 	flag.VisitAll(func(f *flag.Flag) {
+		if f.Usage == "" { // hidden option
+			return
+		}
 		if f.Usage[0] == '-' {
 			fmt.Fprintf(os.Stderr, "  -%s\n   alias for -%s\n\n", f.Name, f.Usage)
 		} else {
@@ -70,6 +78,28 @@ func config() {
 	if cfg.Command != programName {
 		fmt.Printf("command = %q\n", cfg.Command)
 	}
+	if cfg.Cache != defaultCache {
+		fmt.Printf("cache = %q\n", cfg.Cache)
+	}
+	if !cfg.IsServer() {
+		if cfg.Restore != "" {
+			fmt.Printf("restore = %q\n", cfg.Restore)
+		}
+		if cfg.SSH != "" {
+			fmt.Printf("ssh = %q\n", cfg.SSH)
+		}
+		if len(cfg.Identity) > 0 {
+			fmt.Print("identity = ")
+			printlist(cfg.Identity)
+		}
+		if cfg.SSH == "native" {
+			fmt.Printf("knownhosts = %q\n", cfg.KnownHosts)
+			if cfg.HostKey != "" {
+				fmt.Printf("hostkey = %q\n", cfg.HostKey)
+			}
+			fmt.Printf("keepalive = %d\n", cfg.Keepalive)
+		}
+	}
 	if cfg.IsServer() {
 		fmt.Println("# server-side configuration")
 		if cfg.Catalog != "" {
@@ -81,6 +111,12 @@ func config() {
 		if cfg.Maxtries != 0 {
 			fmt.Printf("maxtries = %d\n", cfg.Maxtries)
 		}
+		if cfg.Interval != "" {
+			fmt.Printf("interval = %q\n", cfg.Interval)
+		}
+		if cfg.Keep != 0 {
+			fmt.Printf("keep = %d\n", cfg.Keep)
+		}
 	}
 
 	if len(cfg.Include) > 0 {
@@ -92,36 +128,108 @@ func config() {
 		printlist(cfg.Exclude)
 	}
 
-	if cfg.Expiration.Daily != 0 ||
-		cfg.Expiration.Weekly != 0 ||
-		cfg.Expiration.Monthly != 0 ||
-		cfg.Expiration.Yearly != 0 {
-		fmt.Println("[expiration]")
-		if cfg.Expiration.Daily != 0 {
-			fmt.Printf("daily = %d\n", cfg.Expiration.Daily)
+	printexpiration("expiration", cfg.Expiration)
+	if cfg.Retention.Enabled() {
+		fmt.Println("[retention]")
+		fmt.Printf("daily = %d\nweekly = %d\nmonthly = %d\nyearly = %d\n", cfg.Retention.Daily, cfg.Retention.Weekly, cfg.Retention.Monthly, cfg.Retention.Yearly)
+	}
+	for _, s := range cfg.Schedule {
+		fmt.Println("[[schedule]]")
+		fmt.Printf("name = %q\ninterval = %q\nexpiration = %d\n", s.Name, s.Interval, s.Expiration)
+	}
+
+	profiles := []string{}
+	for p := range cfg.Profile {
+		profiles = append(profiles, p)
+	}
+	sort.Strings(profiles)
+	for _, p := range profiles {
+		prof := cfg.Profile[p]
+		fmt.Printf("[profile.%s]\n", p)
+		fmt.Printf("name = %q\n", cfg.ProfileName(p))
+		if prof.Server != "" {
+			fmt.Printf("server = %q\n", prof.Server)
+		}
+		if prof.User != "" {
+			fmt.Printf("user = %q\n", prof.User)
 		}
-		if cfg.Expiration.Weekly != 0 {
-			fmt.Printf("weekly = %d\n", cfg.Expiration.Weekly)
+		if prof.Port != 0 {
+			fmt.Printf("port = %d\n", prof.Port)
 		}
-		if cfg.Expiration.Monthly != 0 {
-			fmt.Printf("monthly = %d\n", cfg.Expiration.Monthly)
+		if prof.Schedule != "" {
+			fmt.Printf("schedule = %q\n", prof.Schedule)
 		}
-		if cfg.Expiration.Yearly != 0 {
-			fmt.Printf("yearly = %d\n", cfg.Expiration.Yearly)
+		if len(prof.Include) > 0 {
+			fmt.Print("include = ")
+			printlist(prof.Include)
 		}
+		if len(prof.Exclude) > 0 {
+			fmt.Print("exclude = ")
+			printlist(prof.Exclude)
+		}
+		printexpiration("profile."+p+".expiration", prof.Expiration)
 	}
-}
 
-func main() {
-	if logwriter, err := syslog.New(syslog.LOG_NOTICE, filepath.Base(os.Args[0])); err == nil {
-		log.SetOutput(logwriter)
-		log.SetFlags(0) // no need to add timestamp, syslog will do it for us
+	clients := []string{}
+	for c := range cfg.Clients {
+		clients = append(clients, c)
 	}
+	sort.Strings(clients)
+	for _, c := range clients {
+		client := cfg.Clients[c]
+		fmt.Printf("[client.%q]\n", c)
+		if client.Keep != 0 {
+			fmt.Printf("keep = %d\n", client.Keep)
+		}
+		if client.Interval != "" {
+			fmt.Printf("interval = %q\n", client.Interval)
+		}
+		if client.Quota != "" {
+			fmt.Printf("quota = %q\n", client.Quota)
+		}
+		if len(client.Schedules) > 0 {
+			fmt.Print("schedules = ")
+			printlist(client.Schedules)
+		}
+		printexpiration(fmt.Sprintf("client.%q.expiration", c), client.Expiration)
+		if client.Retention.Enabled() {
+			fmt.Printf("[client.%q.retention]\n", c)
+			fmt.Printf("daily = %d\nweekly = %d\nmonthly = %d\nyearly = %d\n", client.Retention.Daily, client.Retention.Weekly, client.Retention.Monthly, client.Retention.Yearly)
+		}
+	}
+}
 
-	setDefaults()
+func printexpiration(section string, e Expiration) {
+	if e.Daily != 0 ||
+		e.Weekly != 0 ||
+		e.Monthly != 0 ||
+		e.Yearly != 0 ||
+		e.Failed != 0 {
+		fmt.Printf("[%s]\n", section)
+		if e.Daily != 0 {
+			fmt.Printf("daily = %d\n", e.Daily)
+		}
+		if e.Weekly != 0 {
+			fmt.Printf("weekly = %d\n", e.Weekly)
+		}
+		if e.Monthly != 0 {
+			fmt.Printf("monthly = %d\n", e.Monthly)
+		}
+		if e.Yearly != 0 {
+			fmt.Printf("yearly = %d\n", e.Yearly)
+		}
+		if e.Failed != 0 {
+			fmt.Printf("failed = %d\n", e.Failed)
+		}
+	}
+}
 
+// globalflags declares the options common to all commands
+func globalflags() {
 	flag.StringVar(&configFile, "config", defaultConfig, "Configuration file")
 	flag.StringVar(&configFile, "c", defaultConfig, "-config")
+	flag.StringVar(&profile, "profile", profile, "Configuration profile")
+	flag.StringVar(&profile, "P", profile, "-profile")
 	flag.BoolVar(&verbose, "verbose", verbose, "Be more verbose")
 	flag.BoolVar(&verbose, "v", verbose, "-verbose")
 	flag.BoolVar(&force, "force", force, "Force action")
@@ -130,6 +238,33 @@ func main() {
 	flag.IntVar(&protocol, "p", protocol, "-protocol")
 	flag.IntVar(&timeout, "timeout", timeout, "Backend timeout (in seconds)")
 	flag.IntVar(&timeout, "t", timeout, "-timeout")
+	flag.StringVar(&compression, "compress", compression, "Stream compression")
+	flag.StringVar(&localvault, "localvault", "", "") // hidden: set by clients using a local vault
+}
+
+func version() {
+	Setup()
+	fmt.Fprintf(cmdout, "%s version %d.%d %s/%s\n", programName, versionMajor, versionMinor, runtime.GOOS, runtime.GOARCH)
+	if verbose {
+		fmt.Fprintln(cmdout, )
+		fmt.Fprintln(cmdout, "Build", buildID)
+		fmt.Fprintln(cmdout, "Go version", runtime.Version())
+		sqliteversion, _, _ := sqlite3.Version()
+		fmt.Fprintln(cmdout, "SQLite version", sqliteversion)
+		fmt.Fprintln(cmdout, "Protocol:", protocolVersion)
+		fmt.Fprintln(cmdout, "Capabilities:", strings.Join(capabilities, " "))
+	}
+}
+
+func main() {
+	if logwriter, err := syslog.New(syslog.LOG_NOTICE, filepath.Base(os.Args[0])); err == nil {
+		log.SetOutput(logwriter)
+		log.SetFlags(0) // no need to add timestamp, syslog will do it for us
+	}
+
+	setDefaults()
+
+	globalflags()
 	flag.Usage = usage
 
 	programFile = os.Args[0]
@@ -158,6 +293,8 @@ func main() {
 	// client commands
 	case "archive", "tar":
 		archive()
+	case "auto", "agent":
+		auto()
 	case "backup", "save":
 		backup()
 	case "expire":
@@ -176,8 +313,26 @@ func main() {
 		register()
 	case "purge", "delete":
 		purge()
+	case "analysis", "analyse", "analyze":
+		analysis()
+	case "annotate":
+		annotate()
+	case "diff", "compare":
+		diff()
+	case "find", "search":
+		find()
+	case "mtree":
+		mtree()
+	case "cat":
+		cat()
+	case "pin":
+		pin(false)
+	case "unpin":
+		pin(true)
 	case "restore":
 		restore()
+	case "store", "import":
+		store()
 	case "resume", "continue":
 		resume()
 	case "verify", "check":
@@ -187,6 +342,8 @@ func main() {
 	// server commands
 	case "data":
 		data()
+	case "catfile":
+		catfile()
 	case "df":
 		df()
 	case "dbcheck", "fsck", "chkdsk":
@@ -203,10 +360,26 @@ func main() {
 		newbackup()
 	case "purgebackup":
 		purgebackup()
+	case "pinbackup":
+		pinbackup()
+	case "annotatebackup":
+		annotatebackup()
 	case "submitfiles":
 		submitfiles()
 	case "convert":
 		convert()
+	case "serve":
+		serve()
+	case "session":
+		session()
+	case "sync":
+		syncvault()
+	case "jobs":
+		jobs()
+	case "nextjob":
+		nextjob()
+	case "jobstatus":
+		jobstatus()
 	// shared commands
 	case "help":
 		fmt.Fprintf(os.Stderr, "Usage: %s help [command]", programName)
@@ -214,33 +387,35 @@ func main() {
 		fmt.Printf("%s is a lightweight network backup system.\n\n", programName)
 		fmt.Printf("Usage:\n\n\t%s COMMAND [options]\n\nCommands:\n", programName)
 		fmt.Printf(`
+    analysis    display the biggest or most often changing files
+    annotate    set the label or comment of a backup
     archive     retrieve files from backup
+    auto        wait for jobs queued by the server
     backup      perform a new backup
+    cat         display the contents of a file from backup
     config      display configuration details
+    diff        compare two backups
     expire      flush old backups
+    find        search files in backups
     history     display saved data history
     info        display existing backups
+    mtree       export a backup as an mtree(5) specification
+    pin         protect a backup from expiration and deletion
     ping        check server connectivity
     purge       delete a backup
     register    send identity to the server
     restore     restore files from backup
     resume      continue a partial backup
+    store       store a tar archive as a new backup
     summary     display a dashboard of existing backups
+    unpin       allow a backup to expire again
     verify      verify a backup
     version     display version information
     web         start the built-in web server
 `)
 		fmt.Printf("\nUse \"%s help [command]\" for more information about a command.\n\n", programName)
 	case "version":
-		Setup()
-		fmt.Printf("%s version %d.%d %s/%s\n", programName, versionMajor, versionMinor, runtime.GOOS, runtime.GOARCH)
-		if verbose {
-			fmt.Println()
-			fmt.Println("Build", buildID)
-			fmt.Println("Go version", runtime.Version())
-			sqliteversion, _, _ := sqlite3.Version()
-			fmt.Println("SQLite version", sqliteversion)
-		}
+		version()
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command '%s'\nTry '--help' for more information.\n", os.Args[0])
 		os.Exit(1)
@@ -6,6 +6,7 @@ import (
 	"path"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"pukcab/tar"
@@ -21,6 +22,9 @@ type BackupMeta struct {
 	Files        int64    `json:"files,omitempty"`
 	Size         int64    `json:"size,omitempty"`
 	Finished     int64    `json:"finished,omitempty"`
+	Pinned       bool     `json:"pinned,omitempty"`
+	Label        string   `json:"label,omitempty"`
+	Comment      string   `json:"comment,omitempty"`
 	LastModified int64    `json:"-"`
 }
 
@@ -28,6 +32,7 @@ type BackupMeta struct {
 type Meta struct {
 	Path       string            `json:"-"`
 	Hash       string            `json:"hash,omitempty"`
+	Digest     string            `json:"sha512,omitempty"`
 	Type       string            `json:"type,omitempty"`
 	Target     string            `json:"target,omitempty"`
 	Owner      string            `json:"owner,omitempty"`
@@ -158,6 +163,8 @@ func HeaderMeta(h *tar.Header) Meta {
 				meta.Size, _ = strconv.ParseInt(v, 10, 64)
 			case "backup.hash":
 				meta.Hash = v
+			case "backup.sha512":
+				meta.Digest = v
 			default:
 				meta.Attributes[k] = v
 			}
@@ -284,6 +291,9 @@ func Backups(repository *git.Repository, name string, schedule string) (list []B
 				switch tag := obj.(type) {
 				case git.Commit:
 					b.LastModified = tag.Author().Date().Unix()
+					if i := strings.Index(tag.Text(), "\n\n"); i >= 0 { // unfinished backups carry their schedule and label in the commit message
+						json.Unmarshal([]byte(tag.Text()[i+2:]), &b)
+					}
 				case git.Tag:
 					json.Unmarshal([]byte(tag.Text()), &b)
 				}
@@ -317,6 +327,9 @@ func Backups(repository *git.Repository, name string, schedule string) (list []B
 				Started:      unixtime(int64(b.Date)),
 				Finished:     unixtime(b.Finished),
 				LastModified: unixtime(b.LastModified),
+				Pinned:       b.Pinned,
+				Label:        b.Label,
+				Comment:      b.Comment,
 			})
 		}
 	}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha512"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"pukcab/tar"
+)
+
+// mtree(5) entry types
+var mtreetypes = map[byte]string{
+	tar.TypeReg:     "file",
+	tar.TypeRegA:    "file",
+	tar.TypeLink:    "file",
+	tar.TypeDir:     "dir",
+	tar.TypeSymlink: "link",
+	tar.TypeBlock:   "block",
+	tar.TypeChar:    "char",
+	tar.TypeFifo:    "fifo",
+}
+
+// mtreeescape encodes a file name like strsvis(3) does for mtree(5)
+func mtreeescape(s string) string {
+	var result strings.Builder
+	for _, c := range []byte(s) {
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\\#*?[", c) >= 0 {
+			fmt.Fprintf(&result, "\\%03o", c)
+		} else {
+			result.WriteByte(c)
+		}
+	}
+	return result.String()
+}
+
+// mtreeunescape decodes a file name encoded by strsvis(3)
+func mtreeunescape(s string) string {
+	var result strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && s[i+1] == '\\' {
+			result.WriteByte('\\')
+			i++
+			continue
+		}
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				result.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		result.WriteByte(s[i])
+	}
+	return result.String()
+}
+
+// mtreeentry formats a backup entry as a full-path mtree(5) line
+func mtreeentry(hdr tar.Header) string {
+	p := "." + path.Join("/", hdr.Name)
+	if p == "./" {
+		p = "."
+	}
+	t, ok := mtreetypes[hdr.Typeflag]
+	if !ok {
+		return ""
+	}
+
+	line := fmt.Sprintf("%s type=%s uid=%d gid=%d mode=%04o", mtreeescape(p), t, hdr.Uid, hdr.Gid, hdr.Mode&07777)
+	if hdr.Uname != "" {
+		line += " uname=" + mtreeescape(hdr.Uname)
+	}
+	if hdr.Gname != "" {
+		line += " gname=" + mtreeescape(hdr.Gname)
+	}
+	if !hdr.ModTime.IsZero() {
+		line += fmt.Sprintf(" time=%d.000000000", hdr.ModTime.Unix())
+	}
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		line += fmt.Sprintf(" size=%d", hdr.Size)
+		if digest := hdr.Xattrs["backup.sha512"]; digest != "" {
+			line += " sha512digest=" + digest
+		}
+	case tar.TypeSymlink:
+		line += " link=" + mtreeescape(hdr.Linkname)
+	case tar.TypeBlock, tar.TypeChar:
+		line += fmt.Sprintf(" device=native,%d,%d", hdr.Devmajor, hdr.Devminor)
+	}
+	return line
+}
+
+// mtree exports the metadata of a backup set as an mtree(5) specification (one line per entry, with full paths)
+func mtree() {
+	date.Set("now")
+
+	flag.StringVar(&name, "name", defaultName, "Backup name")
+	flag.StringVar(&name, "n", defaultName, "-name")
+	flag.Var(&date, "date", "Backup set")
+	flag.Var(&date, "d", "-date")
+	flag.StringVar(&label, "label", "", "Backup label")
+
+	Setup()
+
+	if label != "" {
+		date = labelled(name, label)
+	}
+
+	found := false
+	if err := process("metadata", &Backup{Name: name, Date: date}, func(hdr tar.Header) {
+		switch hdr.Typeflag {
+		case tar.TypeXGlobalHeader:
+			found = true
+			fmt.Println("#mtree v2.0")
+			fmt.Println("#\t   user:", programName)
+			fmt.Println("#\tmachine:", hdr.Name)
+			fmt.Println("#\t   tree: /")
+			fmt.Println("#\t   date:", hdr.ModTime.Format(time.ANSIC))
+			fmt.Println("#\t backup:", hdr.ModTime.Unix())
+			fmt.Println()
+		default:
+			if line := mtreeentry(hdr); line != "" {
+				fmt.Println(line)
+			}
+		}
+	}, flag.Args()...); err != nil {
+		failure.Println(err)
+		log.Fatal(err)
+	}
+
+	if !found {
+		failure.Fatal("Backup not found")
+	}
+}
+
+// mtreecheck compares an existing file with the keywords of an mtree(5) entry and returns the
+// list of keywords which don't match
+func mtreecheck(filename string, keywords map[string]string) (fields []string, err error) {
+	fi, err := os.Lstat(filename)
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range keywords {
+		ok := true
+		switch k {
+		case "type":
+			if hdr.Typeflag == tar.TypeRegA {
+				hdr.Typeflag = tar.TypeReg
+			}
+			ok = mtreetypes[hdr.Typeflag] == v
+		case "uid":
+			ok = strconv.Itoa(hdr.Uid) == v
+		case "gid":
+			ok = strconv.Itoa(hdr.Gid) == v
+		case "uname":
+			ok = Username(hdr.Uid) == mtreeunescape(v)
+		case "gname":
+			ok = Groupname(hdr.Gid) == mtreeunescape(v)
+		case "mode":
+			m, err := strconv.ParseInt(v, 8, 64)
+			ok = err == nil && m&07777 == hdr.Mode&07777
+		case "size":
+			ok = fi.Mode().IsRegular() && strconv.FormatInt(fi.Size(), 10) == v
+		case "time":
+			ok = strings.SplitN(v, ".", 2)[0] == strconv.FormatInt(hdr.ModTime.Unix(), 10)
+		case "link":
+			target, err := os.Readlink(filename)
+			ok = err == nil && target == mtreeunescape(v)
+		case "sha512", "sha512digest":
+			ok = fi.Mode().IsRegular() && sha512file(filename) == v
+		}
+		if !ok {
+			fields = append(fields, k)
+		}
+	}
+	sort.Strings(fields)
+	return fields, nil
+}
+
+func sha512file(filename string) string {
+	if file, err := os.Open(filename); err == nil {
+		defer file.Close()
+		h := sha512.New()
+		if _, err := io.Copy(h, file); err == nil {
+			return fmt.Sprintf("%x", h.Sum(nil))
+		}
+	}
+	return ""
+}
+
+// verifymtree checks a file system tree against an mtree(5) specification, without needing the server
+func verifymtree(spec string, root string) (modified int, missing int, err error) {
+	in := os.Stdin
+	if spec != "-" {
+		if in, err = os.Open(spec); err != nil {
+			return
+		}
+		defer in.Close()
+	}
+
+	defaults := make(map[string]string)
+	cwd := "."
+	scanner := bufio.NewScanner(in)
+	line := ""
+	for scanner.Scan() {
+		line += strings.TrimSpace(scanner.Text())
+		if strings.HasSuffix(line, "\\") { // continued on next line
+			line = strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		fields := strings.Fields(line)
+		line = ""
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch fields[0] {
+		case "/set":
+			for _, f := range fields[1:] {
+				kv := strings.SplitN(f, "=", 2)
+				if len(kv) == 2 {
+					defaults[kv[0]] = kv[1]
+				} else {
+					defaults[kv[0]] = ""
+				}
+			}
+			continue
+		case "/unset":
+			for _, f := range fields[1:] {
+				if f == "all" {
+					defaults = make(map[string]string)
+				}
+				delete(defaults, f)
+			}
+			continue
+		case "..":
+			cwd = path.Dir(cwd)
+			continue
+		}
+
+		keywords := make(map[string]string)
+		for k, v := range defaults {
+			keywords[k] = v
+		}
+		for _, f := range fields[1:] {
+			kv := strings.SplitN(f, "=", 2)
+			if len(kv) == 2 {
+				keywords[kv[0]] = kv[1]
+			} else {
+				keywords[kv[0]] = ""
+			}
+		}
+		p := mtreeunescape(fields[0])
+		if !strings.Contains(p, "/") { // relative entry
+			p = path.Join(cwd, p)
+			if keywords["type"] == "dir" && fields[0] != "." {
+				cwd = p
+			}
+		}
+		if _, ignored := keywords["ignore"]; ignored {
+			continue
+		}
+		delete(keywords, "nlink") // not recorded in backups
+		delete(keywords, "flags")
+
+		filename := filepath.Join(root, filepath.FromSlash(p))
+		changed, err := mtreecheck(filename, keywords)
+		switch {
+		case os.IsNotExist(err):
+			if _, optional := keywords["optional"]; !optional {
+				missing++
+				fmt.Printf("- %s\n", filename)
+			}
+		case err != nil:
+			modified++
+			fmt.Printf("! %s: %s\n", filename, err)
+		case len(changed) > 0:
+			modified++
+			status := "m"
+			for _, k := range changed {
+				if k == "size" || k == "sha512" || k == "sha512digest" {
+					status = "M"
+				}
+			}
+			fmt.Printf("%s %s (%s)\n", status, filename, strings.Join(changed, ", "))
+		}
+	}
+	err = scanner.Err()
+	return
+}
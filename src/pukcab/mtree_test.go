@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMtreeEscape(t *testing.T) {
+	tests := []struct {
+		name    string
+		escaped string
+	}{
+		{"", ""},
+		{"./etc/passwd", "./etc/passwd"},
+		{"./my file", `./my\040file`},
+		{"./tab\there", `./tab\011here`},
+		{"./new\nline", `./new\012line`},
+		{`./back\slash`, `./back\134slash`},
+		{"./#comment", `./\043comment`},
+		{"./glob*?[", `./glob\052\077\133`},
+		{"./café", `./caf\303\251`},
+		{"./del\x7f", `./del\177`},
+		{"./trailing ", `./trailing\040`},
+	}
+
+	for _, test := range tests {
+		if escaped := mtreeescape(test.name); escaped != test.escaped {
+			t.Errorf("mtreeescape(%q) = %q, expected %q", test.name, escaped, test.escaped)
+		}
+		if name := mtreeunescape(test.escaped); name != test.name {
+			t.Errorf("mtreeunescape(%q) = %q, expected %q", test.escaped, name, test.name)
+		}
+	}
+}
+
+func TestMtreeUnescape(t *testing.T) {
+	tests := []struct {
+		escaped string
+		name    string
+	}{
+		{`a\\b`, `a\b`},
+		{`a\b`, `a\b`},
+		{`a\0`, `a\0`},
+		{`a\999`, `a\999`},
+		{`a\`, `a\`},
+	}
+
+	for _, test := range tests {
+		if name := mtreeunescape(test.escaped); name != test.name {
+			t.Errorf("mtreeunescape(%q) = %q, expected %q", test.escaped, name, test.name)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// protocol capabilities
+const (
+	capJSON    = "json"    // JSON-encoded backup headers and replies
+	capErrors  = "errors"  // structured error frames
+	capSession = "session" // multiplexed sessions
+	capJobs    = "jobs"    // jobs queued for clients (pukcab auto)
+)
+
+var capabilities = []string{capJSON, capErrors, capSession, capJobs, compressZstd, compressLZ4}
+var negotiated = false
+
+// NewBackupReply is returned by the server when creating a new backup set (protocol version 2)
+type NewBackupReply struct {
+	Protocol     int      `json:"protocol"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Date         BackupID `json:"date"`
+	Previous     BackupID `json:"previous,omitempty"`
+	Error        string   `json:"error,omitempty"`
+	Skipped      bool     `json:"skipped,omitempty"`
+}
+
+// SubmitReply is returned by the server after receiving files (protocol version 2)
+type SubmitReply struct {
+	Date     BackupID `json:"date"`
+	Files    int64    `json:"files"`
+	Missing  int64    `json:"missing"`
+	Complete bool     `json:"complete"`
+}
+
+// ErrorFrame is an error reported by the server (protocol version 2)
+type ErrorFrame struct {
+	Error   string `json:"error"`
+	Command string `json:"command,omitempty"`
+	Code    int    `json:"code,omitempty"`
+}
+
+// Capable checks whether the server supports a given capability
+func Capable(c string) bool {
+	if protocol < 2 {
+		return false
+	}
+	for _, capability := range capabilities {
+		if capability == c {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate finds out which protocol version and capabilities the server supports (by running
+// "version -verbose", which any server accepts): version 1 uses gob-encoded backup headers and
+// plain text replies and errors, version 2 uses JSON; a client falls back to version 1 with older
+// servers and a server always answers using the version requested with -protocol
+func negotiate() {
+	if negotiated {
+		return
+	}
+	negotiated = true
+
+	if cfg.Server == "" || isvault() { // the backend is this very binary
+		return
+	}
+
+	requested := protocol
+	protocol = 1 // understood by all servers
+	cmd := remotecommand("version", "-verbose")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		protocol = requested
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		protocol = requested
+		return
+	}
+
+	server := 1
+	var servercapabilities []string
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		switch field := strings.SplitN(scanner.Text(), ":", 2); strings.TrimSpace(field[0]) {
+		case "Protocol":
+			if len(field) > 1 {
+				if v, err := strconv.Atoi(strings.TrimSpace(field[1])); err == nil {
+					server = v
+				}
+			}
+		case "Capabilities":
+			if len(field) > 1 {
+				servercapabilities = strings.Fields(field[1])
+			}
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		debug.Println("Protocol negotiation failed:", err)
+	}
+
+	protocol = requested
+	if server < protocol {
+		protocol = server
+	}
+	capabilities = servercapabilities
+	debug.Println("Negotiated protocol", protocol, capabilities)
+}
+
+// ReadBackupInfo decodes a backup header
+func ReadBackupInfo(r io.Reader) (header BackupInfo, err error) {
+	if Capable(capJSON) {
+		err = json.NewDecoder(r).Decode(&header)
+	} else {
+		err = gob.NewDecoder(r).Decode(&header)
+	}
+	return
+}
+
+// ReadSubmitReply decodes the reply of submitfiles
+func ReadSubmitReply(r io.Reader) (reply SubmitReply, err error) {
+	if Capable(capJSON) {
+		err = json.NewDecoder(r).Decode(&reply)
+		return
+	}
+
+	text, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+	if _, err = fmt.Sscanf(string(text), "Backup %d complete (%d files)", &reply.Date, &reply.Files); err == nil {
+		reply.Complete = true
+		return
+	}
+	var received int64
+	_, err = fmt.Sscanf(string(text), "Received %d files for backup %d (%d files to go)", &received, &reply.Date, &reply.Missing)
+	reply.Files = received + reply.Missing
+	return
+}
+
+// frameWriter sends text written to it as error frames
+type frameWriter struct {
+	w io.Writer
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if _, err := io.WriteString(f.w, JSON(ErrorFrame{Error: line, Command: os.Args[0]})); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// SendErrorFrames switches error reporting to structured frames (server side)
+func SendErrorFrames() {
+	if protocol > 1 {
+		failure.SetOutput(&frameWriter{cmderr})
+	}
+}
+
+// ParseErrorFrame decodes an error frame (returns false if text isn't a frame)
+func ParseErrorFrame(text string) (frame ErrorFrame, ok bool) {
+	if !strings.HasPrefix(text, "{") {
+		return frame, false
+	}
+	if err := json.Unmarshal([]byte(text), &frame); err != nil || frame.Error == "" {
+		return frame, false
+	}
+	return frame, true
+}
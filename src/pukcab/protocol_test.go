@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadSubmitReply(t *testing.T) {
+	defer func(p int, c []string) { protocol, capabilities = p, c }(protocol, capabilities)
+
+	tests := []struct {
+		protocol int
+		reply    string
+		expected SubmitReply
+		fails    bool
+	}{
+		{protocol: 1, reply: "Backup 1700000000 complete (42 files)\n", expected: SubmitReply{Date: 1700000000, Files: 42, Complete: true}},
+		{protocol: 1, reply: "Received 40 files for backup 1700000000 (2 files to go)\n", expected: SubmitReply{Date: 1700000000, Files: 42, Missing: 2}},
+		{protocol: 1, reply: "", fails: true},
+		{protocol: 1, reply: "Something else\n", fails: true},
+		{protocol: 2, reply: JSON(SubmitReply{Date: 1700000000, Files: 42, Complete: true}), expected: SubmitReply{Date: 1700000000, Files: 42, Complete: true}},
+		{protocol: 2, reply: JSON(SubmitReply{Date: 1700000000, Files: 42, Missing: 2}), expected: SubmitReply{Date: 1700000000, Files: 42, Missing: 2}},
+		{protocol: 2, reply: "Backup 1700000000 complete (42 files)\n", fails: true},
+	}
+
+	for _, test := range tests {
+		protocol, capabilities = test.protocol, []string{capJSON}
+		reply, err := ReadSubmitReply(strings.NewReader(test.reply))
+		if test.fails {
+			if err == nil {
+				t.Errorf("ReadSubmitReply(%q) = %+v, expected an error", test.reply, reply)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ReadSubmitReply(%q) failed: %s", test.reply, err)
+			continue
+		}
+		if reply != test.expected {
+			t.Errorf("ReadSubmitReply(%q) = %+v, expected %+v", test.reply, reply, test.expected)
+		}
+	}
+}
+
+func TestParseErrorFrame(t *testing.T) {
+	tests := []struct {
+		text  string
+		frame ErrorFrame
+		ok    bool
+	}{
+		{`{"error":"Missing backup name","command":"newbackup","code":1}`, ErrorFrame{Error: "Missing backup name", Command: "newbackup", Code: 1}, true},
+		{`{"error":"Quota exceeded"}`, ErrorFrame{Error: "Quota exceeded"}, true},
+		{"Missing backup name", ErrorFrame{}, false},
+		{"{not json", ErrorFrame{}, false},
+		{`{"command":"newbackup"}`, ErrorFrame{}, false},
+	}
+
+	for _, test := range tests {
+		frame, ok := ParseErrorFrame(test.text)
+		if ok != test.ok || (ok && frame != test.frame) {
+			t.Errorf("ParseErrorFrame(%q) = %+v, %v, expected %+v, %v", test.text, frame, ok, test.frame, test.ok)
+		}
+	}
+}
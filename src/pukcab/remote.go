@@ -2,14 +2,23 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 )
 
 func sshcopyid() error {
 	cmd := []string{"-i", "-oStrictHostKeyChecking=no", "-oUserKnownHostsFile=/dev/null"}
+	if cfg.SSH == "native" {
+		if err := pinhostkey(); err != nil {
+			return err
+		}
+		cmd = []string{"-i", "-oStrictHostKeyChecking=yes", "-oUserKnownHostsFile=" + cfg.KnownHosts}
+	}
 	if cfg.Port > 0 {
 		cmd = append(cmd, "-p", strconv.Itoa(cfg.Port))
 	}
@@ -35,7 +44,13 @@ func sshcopyid() error {
 }
 
 func ssh(arg ...string) *exec.Cmd {
-	cmd := []string{"-C", "-oLogLevel=ERROR", "-oBatchMode=yes", "-oStrictHostKeyChecking=no", "-oUserKnownHostsFile=/dev/null"}
+	cmd := []string{"-oLogLevel=ERROR", "-oBatchMode=yes", "-oStrictHostKeyChecking=no", "-oUserKnownHostsFile=/dev/null"}
+	if Compression() == "" { // let ssh compress data
+		cmd = append(cmd, "-C")
+	}
+	for _, id := range cfg.Identity {
+		cmd = append(cmd, "-i", id)
+	}
 	if cfg.User != "" {
 		cmd = append(cmd, "-l", cfg.User)
 	}
@@ -47,11 +62,166 @@ func ssh(arg ...string) *exec.Cmd {
 	return exec.Command("ssh", cmd...)
 }
 
-func remotecommand(arg ...string) (rcmd *exec.Cmd) {
+// Command is a server command run through the current transport (local process, ssh, session or HTTP)
+type Command struct {
+	Path   string
+	Args   []string
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	cmd    *exec.Cmd
+	remote transport
+
+	compression string
+	decoder     *io.PipeWriter
+	decoded     chan struct{}
+}
+
+// transport runs a command without a local process (local vault, built-in SSH client, session stream or HTTP request)
+type transport interface {
+	StdinPipe() (io.WriteCloser, error)
+	StdoutPipe() (io.ReadCloser, error)
+	Start(stdin io.Reader, stdout io.Writer, stderr io.Writer) error
+	Wait() error
+}
+
+// ExitError reports the exit status of a command run in a session
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return "exit status " + strconv.Itoa(e.Code)
+}
+
+// exitstatus returns the exit status of a command (or -1 if it didn't exit normally)
+func exitstatus(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case *ExitError:
+		return e.Code
+	case *exec.ExitError:
+		return ExitCode(e.ProcessState)
+	}
+	return -1
+}
+
+func newcommand(cmd *exec.Cmd) *Command {
+	return &Command{
+		Path:   cmd.Path,
+		Args:   cmd.Args,
+		Stderr: NewLogStream(failure),
+		cmd:    cmd,
+	}
+}
+
+// StdinPipe returns a pipe connected to the command's standard input
+func (c *Command) StdinPipe() (w io.WriteCloser, err error) {
+	if c.remote != nil {
+		w, err = c.remote.StdinPipe()
+	} else {
+		w, err = c.cmd.StdinPipe()
+	}
+	if err == nil && c.compression != "" {
+		w = NewCompressWriter(w, c.compression)
+	}
+	return
+}
+
+// StdoutPipe returns a pipe connected to the command's standard output
+func (c *Command) StdoutPipe() (r io.ReadCloser, err error) {
+	if c.remote != nil {
+		r, err = c.remote.StdoutPipe()
+	} else {
+		r, err = c.cmd.StdoutPipe()
+	}
+	if err == nil && c.compression != "" {
+		r = NewCompressReader(r, c.compression)
+	}
+	return
+}
+
+// Start starts the command
+func (c *Command) Start() error {
+	stdin, stdout := c.Stdin, c.Stdout
+	if c.compression != "" {
+		if stdin != nil {
+			r, w := io.Pipe()
+			go func() {
+				cw := NewCompressWriter(w, c.compression)
+				_, err := io.Copy(cw, c.Stdin)
+				cw.Flush()
+				w.CloseWithError(err)
+			}()
+			stdin = r
+		}
+		if stdout != nil {
+			r, w := io.Pipe()
+			c.decoder, c.decoded = w, make(chan struct{})
+			go func() {
+				io.Copy(c.Stdout, NewCompressReader(r, c.compression))
+				io.Copy(ioutil.Discard, r)
+				close(c.decoded)
+			}()
+			stdout = w
+		}
+	}
+
+	if c.remote != nil {
+		return c.remote.Start(stdin, stdout, c.Stderr)
+	}
+	if c.cmd.Stdin == nil && stdin != nil {
+		c.cmd.Stdin = stdin
+	}
+	if c.cmd.Stdout == nil && stdout != nil {
+		c.cmd.Stdout = stdout
+	}
+	if c.cmd.Stderr == nil && c.Stderr != nil {
+		c.cmd.Stderr = c.Stderr
+	}
+	return c.cmd.Start()
+}
+
+// Wait waits for the command to complete
+func (c *Command) Wait() (err error) {
+	if c.remote != nil {
+		err = c.remote.Wait()
+	} else {
+		err = c.cmd.Wait()
+	}
+	if c.decoder != nil {
+		c.decoder.Close()
+		<-c.decoded
+	}
+	return
+}
+
+// Run starts the command and waits for it to complete
+func (c *Command) Run() error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+// isvault checks whether backups are stored in a local folder (server = "file:///path")
+func isvault() bool {
+	return strings.HasPrefix(cfg.Server, "file://")
+}
+
+func vaultpath() string {
+	return strings.TrimPrefix(cfg.Server, "file://")
+}
+
+func remotecommand(arg ...string) (rcmd *Command) {
 	os.Setenv("SSH_CLIENT", "")
 	os.Setenv("SSH_CONNECTION", "")
 
-	if cfg.Server != "" {
+	negotiate()
+
+	if cfg.Server != "" && !isvault() {
 		cmd := []string{cfg.Command}
 		cmd = append(cmd, arg[0])
 		if protocol > 0 {
@@ -62,25 +232,151 @@ func remotecommand(arg ...string) (rcmd *exec.Cmd) {
 		if timeout != defaultTimeout {
 			cmd = append(cmd, "-timeout", strconv.Itoa(timeout))
 		}
+		if s := currentsession(); s != nil { // the session itself is compressed
+			cmd = append(cmd, arg[1:]...)
+			return &Command{
+				Path:   cfg.Command,
+				Args:   cmd,
+				Stderr: NewLogStream(failure),
+				remote: s.NewStream(cmd[1:]),
+			}
+		}
+		compression := Compression()
+		if compression != "" {
+			cmd = append(cmd, "-compress", compression)
+		}
 		cmd = append(cmd, arg[1:]...)
-		rcmd = ssh(cmd...)
+		if ishttp() {
+			h, err := newhttpcommand(cmd[1:])
+			if err != nil {
+				failure.Println(err)
+				log.Fatal(err)
+			}
+			return &Command{
+				Path:        cfg.Server,
+				Args:        cmd,
+				Stderr:      NewLogStream(failure),
+				remote:      h,
+				compression: compression,
+			}
+		}
+		if cfg.SSH == "native" {
+			rcmd = &Command{
+				Path:   cfg.Server,
+				Args:   cmd,
+				Stderr: NewLogStream(failure),
+				remote: newsshcommand(cmd),
+			}
+		} else {
+			rcmd = newcommand(ssh(cmd...))
+		}
+		rcmd.compression = compression
 	} else {
 		cmd := []string{arg[0]}
+		if isvault() { // the backend is this very binary, working on a local vault
+			cmd = append(cmd, "-config", configFile, "-localvault", vaultpath())
+		}
+		if protocol != protocolVersion {
+			cmd = append(cmd, "-protocol", strconv.Itoa(protocol))
+		}
 		if timeout != defaultTimeout {
 			cmd = append(cmd, "-timeout", strconv.Itoa(timeout))
 		}
 		cmd = append(cmd, arg[1:]...)
-		rcmd = exec.Command(programFile, cmd...)
+		if isvault() && inprocess {
+			return &Command{
+				Path:   programFile,
+				Args:   cmd,
+				Stderr: NewLogStream(failure),
+				remote: &LocalCommand{args: cmd, done: make(chan struct{})},
+			}
+		}
+		rcmd = newcommand(exec.Command(programFile, cmd...))
 	}
-	rcmd.Stderr = NewLogStream(failure)
 	return rcmd
 }
 
+// inprocess is set when the commands of a local vault can run within this process
+var inprocess = true
+
+// LocalCommand is a server command run on a local vault (within this process, unless another
+// command is already running)
+type LocalCommand struct {
+	args   []string
+	stdin  io.Reader
+	stdout *io.PipeWriter
+	done   chan struct{}
+	status int
+	err    error
+}
+
+// StdinPipe returns a pipe connected to the command's standard input
+func (l *LocalCommand) StdinPipe() (io.WriteCloser, error) {
+	r, w := io.Pipe()
+	l.stdin = r
+	return w, nil
+}
+
+// StdoutPipe returns a pipe connected to the command's standard output
+func (l *LocalCommand) StdoutPipe() (io.ReadCloser, error) {
+	r, w := io.Pipe()
+	l.stdout = w
+	return r, nil
+}
+
+// Start runs the command
+func (l *LocalCommand) Start(stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	if l.stdin == nil {
+		l.stdin = stdin
+	}
+	if l.stdin == nil {
+		l.stdin = strings.NewReader("")
+	}
+	var out io.Writer = ioutil.Discard
+	if l.stdout != nil {
+		out = l.stdout
+	} else if stdout != nil {
+		out = stdout
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+
+	command := sessioncommand(l.args[0])
+	inprocess := command != nil && reserve()
+	defaults := saveglobals()
+	go func() {
+		defer close(l.done)
+		if inprocess {
+			l.status, l.err = call(command, defaults, l.args, l.stdin, out, stderr)
+			release()
+		} else {
+			l.status, l.err = spawn(l.args, l.stdin, out, stderr)
+		}
+		if l.stdout != nil {
+			l.stdout.CloseWithError(l.err)
+		}
+	}()
+	return nil
+}
+
+// Wait waits for the command to complete
+func (l *LocalCommand) Wait() error {
+	<-l.done
+	if l.err != nil {
+		return l.err
+	}
+	if l.status != 0 {
+		return &ExitError{Code: l.status}
+	}
+	return nil
+}
+
 func switchuser() {
 	if cfg.Server == "" && cfg.User != "" {
 		if err := Impersonate(cfg.User); err != nil {
 			fmt.Fprintln(os.Stderr, "Switch to user", cfg.User, ":", err)
-			log.Fatal("Switch to user ", cfg.User, ": ", err)
+			fatal("Switch to user ", cfg.User, ": ", err)
 		}
 	}
 }
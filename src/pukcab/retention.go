@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Retention defines how many daily, weekly, monthly and yearly backups to keep (grandfather-father-son)
+type Retention struct{ Daily, Weekly, Monthly, Yearly int }
+
+// Enabled checks whether count-based retention is configured
+func (r Retention) Enabled() bool {
+	return r.Daily > 0 || r.Weekly > 0 || r.Monthly > 0 || r.Yearly > 0
+}
+
+// Policy decides which backups of a client to keep, across all schedules
+type Policy struct {
+	Retention             // maximum number of backups to keep per period
+	Expiration Expiration // maximum age (in days) of backups to keep per period
+	Minimum    int        // minimum number of complete backups to keep
+}
+
+// Decision records whether a backup is kept, and under which rules
+type Decision struct {
+	Backup
+	Keep  bool
+	Rules []string
+}
+
+type period struct {
+	name  string
+	count int
+	days  int64
+	key   func(time.Time) string
+}
+
+func (p Policy) periods() []period {
+	return []period{
+		{"daily", p.Daily, p.Expiration.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", p.Weekly, p.Expiration.Weekly, func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", y, w)
+		}},
+		{"monthly", p.Monthly, p.Expiration.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", p.Yearly, p.Expiration.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+}
+
+// Plan applies the policy to the backups of a single client (the most recent backup of each period is kept)
+func (p Policy) Plan(backups []Backup, now time.Time) []Decision {
+	plan := make([]Decision, len(backups))
+	for i, b := range backups {
+		plan[i].Backup = b
+	}
+	sort.Slice(plan, func(i, j int) bool { return plan[i].Date > plan[j].Date }) // most recent first
+
+	complete := []*Decision{}
+	for i := range plan {
+		if plan[i].Finished.IsZero() {
+			plan[i].Rules = append(plan[i].Rules, "unfinished")
+		} else {
+			complete = append(complete, &plan[i])
+		}
+	}
+
+	for i, d := range complete {
+		switch {
+		case i == 0:
+			d.Rules = append(d.Rules, "latest")
+		case i < p.Minimum:
+			d.Rules = append(d.Rules, "minimum")
+		}
+	}
+
+	for _, r := range p.periods() {
+		if r.count <= 0 && r.days <= 0 {
+			continue
+		}
+		seen := make(map[string]struct{})
+		for _, d := range complete {
+			t := d.Date.Time().Local()
+			if r.days > 0 && now.Sub(t) > time.Duration(r.days)*24*time.Hour {
+				break
+			}
+			k := r.key(t)
+			if _, ok := seen[k]; ok {
+				continue
+			}
+			if r.count > 0 && len(seen) >= r.count {
+				break
+			}
+			seen[k] = struct{}{}
+			d.Rules = append(d.Rules, r.name)
+		}
+	}
+
+	for i := range plan {
+		plan[i].Keep = len(plan[i].Rules) > 0
+	}
+	sort.Slice(plan, func(i, j int) bool { return plan[i].Date < plan[j].Date })
+	return plan
+}
+
+// String describes a decision (as shown by expire --plan)
+func (d Decision) String() string {
+	action := "delete"
+	if d.Keep {
+		action = "keep"
+	}
+	return fmt.Sprintf("%d\t%s\t%s\t%s\t%s", d.Date, d.Name, d.Schedule, action, strings.Join(d.Rules, ","))
+}
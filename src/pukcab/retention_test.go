@@ -0,0 +1,144 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// day returns a backup taken at noon on a given day of March 2024 (0 and below are in February)
+func day(d int, finished bool) Backup {
+	t := time.Date(2024, time.March, d, 12, 0, 0, 0, time.Local)
+	b := Backup{Date: BackupID(t.Unix()), Name: "client", Schedule: "daily"}
+	if finished {
+		b.Finished = t.Add(time.Hour)
+	}
+	return b
+}
+
+func backupdays(from, to int) (backups []Backup) {
+	for d := from; d <= to; d++ {
+		backups = append(backups, day(d, true))
+	}
+	return
+}
+
+func TestPolicyPlan(t *testing.T) {
+	now := time.Date(2024, time.March, 20, 18, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name    string
+		policy  Policy
+		backups []Backup
+		kept    map[int]string // day => rules
+	}{
+		{
+			name:    "latest only",
+			policy:  Policy{},
+			backups: backupdays(1, 5),
+			kept:    map[int]string{5: "latest"},
+		},
+		{
+			name:    "daily",
+			policy:  Policy{Retention: Retention{Daily: 3}},
+			backups: backupdays(1, 20),
+			kept:    map[int]string{20: "latest,daily", 19: "daily", 18: "daily"},
+		},
+		{
+			name:    "daily and weekly", // March 18-24 and 11-17 are ISO weeks 12 and 11
+			policy:  Policy{Retention: Retention{Daily: 3, Weekly: 2}},
+			backups: backupdays(1, 20),
+			kept:    map[int]string{20: "latest,daily,weekly", 19: "daily", 18: "daily", 17: "weekly"},
+		},
+		{
+			name:    "weekly and monthly",
+			policy:  Policy{Retention: Retention{Weekly: 4, Monthly: 2}},
+			backups: append([]Backup{day(-10, true), day(-1, true)}, backupdays(1, 20)...), // February 19 and 28
+			kept:    map[int]string{20: "latest,weekly,monthly", 17: "weekly", 10: "weekly", 3: "weekly", -1: "monthly"},
+		},
+		{
+			name:    "one backup per period",
+			policy:  Policy{Retention: Retention{Daily: 2}},
+			backups: []Backup{day(19, true), day(20, true), {Date: day(20, true).Date - 3600, Finished: now}},
+			kept:    map[int]string{20: "latest,daily", 19: "daily"},
+		},
+		{
+			name:    "minimum",
+			policy:  Policy{Retention: Retention{Daily: 1}, Minimum: 3},
+			backups: backupdays(1, 5),
+			kept:    map[int]string{5: "latest,daily", 4: "minimum", 3: "minimum"},
+		},
+		{
+			name:    "unfinished",
+			policy:  Policy{Retention: Retention{Daily: 2}},
+			backups: append(backupdays(1, 4), day(5, false)),
+			kept:    map[int]string{5: "unfinished", 4: "latest,daily", 3: "daily"},
+		},
+		{
+			name:    "unfinished only",
+			policy:  Policy{Minimum: 2},
+			backups: []Backup{day(4, false), day(5, false)},
+			kept:    map[int]string{4: "unfinished", 5: "unfinished"},
+		},
+		{
+			name:    "expiration",
+			policy:  Policy{Expiration: Expiration{Daily: 3}},
+			backups: backupdays(1, 20),
+			kept:    map[int]string{20: "latest,daily", 19: "daily", 18: "daily"},
+		},
+		{
+			name:    "count within expiration",
+			policy:  Policy{Retention: Retention{Weekly: 10}, Expiration: Expiration{Weekly: 14}},
+			backups: backupdays(1, 20),
+			kept:    map[int]string{20: "latest,weekly", 17: "weekly", 10: "weekly"},
+		},
+	}
+
+	for _, test := range tests {
+		plan := test.policy.Plan(test.backups, now)
+		if len(plan) != len(test.backups) {
+			t.Errorf("%s: %d decisions for %d backups", test.name, len(plan), len(test.backups))
+			continue
+		}
+
+		expected := make(map[BackupID]string)
+		for d, rules := range test.kept {
+			expected[day(d, true).Date] = rules
+		}
+		kept := make(map[BackupID]string)
+		for i, d := range plan {
+			if i > 0 && plan[i-1].Date >= d.Date {
+				t.Errorf("%s: decisions are not sorted by date", test.name)
+			}
+			if d.Keep != (len(d.Rules) > 0) {
+				t.Errorf("%s: backup %d kept=%v with rules %q", test.name, d.Date, d.Keep, d.Rules)
+			}
+			if d.Keep {
+				kept[d.Date] = strings.Join(d.Rules, ",")
+			}
+		}
+		if !reflect.DeepEqual(kept, expected) {
+			t.Errorf("%s: kept %v, expected %v", test.name, kept, expected)
+		}
+	}
+}
+
+func TestRetentionEnabled(t *testing.T) {
+	tests := []struct {
+		retention Retention
+		enabled   bool
+	}{
+		{Retention{}, false},
+		{Retention{Daily: 1}, true},
+		{Retention{Weekly: 1}, true},
+		{Retention{Monthly: 1}, true},
+		{Retention{Yearly: 1}, true},
+	}
+
+	for _, test := range tests {
+		if enabled := test.retention.Enabled(); enabled != test.enabled {
+			t.Errorf("%+v.Enabled() = %v, expected %v", test.retention, enabled, test.enabled)
+		}
+	}
+}
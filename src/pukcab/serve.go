@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// commands a restricted client may run (true if the command is bound to the client's backup name)
+var allowed = map[string]bool{
+	"version":        false,
+	"df":             false,
+	"newbackup":      true,
+	"submitfiles":    true,
+	"metadata":       true,
+	"timeline":       true,
+	"data":           true,
+	"catfile":        true,
+	"purgebackup":    true,
+	"pinbackup":      true,
+	"annotatebackup": true,
+	"expirebackup":   true,
+	"session":        true,
+	"nextjob":        true,
+	"jobstatus":      true,
+}
+
+// shellsplit splits a command line into words, honouring quotes and backslashes like a POSIX shell
+func shellsplit(s string) (words []string, err error) {
+	var word strings.Builder
+	inword := false
+	quote := rune(0)
+	escaped := false
+
+	for _, c := range s {
+		switch {
+		case escaped:
+			if quote == '"' && !strings.ContainsRune("$`\"\\\n", c) { // only these can be escaped within double quotes
+				word.WriteRune('\\')
+			}
+			if c != '\n' { // line continuation
+				word.WriteRune(c)
+				inword = true
+			}
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case quote == '"':
+			switch c {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			default:
+				word.WriteRune(c)
+			}
+		case c == '\\':
+			escaped = true
+		case c == '\'' || c == '"':
+			quote, inword = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inword {
+				words = append(words, word.String())
+				word.Reset()
+				inword = false
+			}
+		case strings.ContainsRune(";&|<>`$()", c):
+			return nil, fmt.Errorf("Unexpected %q in command", c)
+		default:
+			word.WriteRune(c)
+			inword = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("Unterminated command")
+	}
+	if inword {
+		words = append(words, word.String())
+	}
+	return
+}
+
+// isflag checks whether an argument is one of the given flags (returns true as second value if its value is included)
+func isflag(arg string, names ...string) (bool, bool) {
+	if !strings.HasPrefix(arg, "-") {
+		return false, false
+	}
+	arg = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+	value := false
+	if i := strings.IndexByte(arg, '='); i >= 0 {
+		arg, value = arg[:i], true
+	}
+	for _, n := range names {
+		if arg == n {
+			return true, value
+		}
+	}
+	return false, false
+}
+
+// restrict checks a server command issued by a given client and binds it to the client's backup name
+func restrict(client string, args []string) ([]string, error) {
+	if len(args) == 0 {
+		return nil, errors.New("Missing command")
+	}
+
+	bound, ok := allowed[args[0]]
+	if !ok {
+		return nil, fmt.Errorf("Command %q not allowed", args[0])
+	}
+
+	result := []string{args[0]}
+	if bound {
+		result = append(result, "-name", client)
+	}
+	for i := 1; i < len(args); i++ {
+		if match, _ := isflag(args[i], "force", "F"); match { // clients can't override the server's policy
+			continue
+		}
+		if match, value := isflag(args[i], "name", "n", "config", "c", "profile", "P", "localvault"); match {
+			if !value {
+				i++ // skip flag value
+			}
+			continue
+		}
+		result = append(result, args[i])
+	}
+
+	return result, nil
+}
+
+func serve() {
+	client := ""
+	flag.StringVar(&client, "client", client, "Client name")
+
+	Setup()
+	cfg.ServerOnly()
+
+	if client == "" {
+		failure.Println("Missing client name")
+		log.Fatal("Missing client name")
+	}
+
+	command := os.Getenv("SSH_ORIGINAL_COMMAND")
+	words, err := shellsplit(command)
+	if err == nil && len(words) < 2 {
+		err = errors.New("Missing command")
+	}
+	if err == nil {
+		words, err = restrict(client, words[1:]) // skip program name
+	}
+	if err != nil {
+		failure.Println(err)
+		log.Printf("Denied command: client=%q command=%q msg=%q error=warn\n", client, command, err)
+		os.Exit(1)
+	}
+
+	log.Printf("Allowed command: client=%q command=%q\n", client, strings.Join(words, " "))
+
+	cmd := exec.Command(programFile, words...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if cmd.ProcessState != nil {
+			os.Exit(ExitCode(cmd.ProcessState))
+		}
+		failure.Println(err)
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestShellsplit(t *testing.T) {
+	tests := []struct {
+		command string
+		words   []string
+		fails   bool
+	}{
+		{command: "", words: nil},
+		{command: "pukcab data -name client", words: []string{"pukcab", "data", "-name", "client"}},
+		{command: "  a \t b\n", words: []string{"a", "b"}},
+		{command: `a 'b c' "d e"`, words: []string{"a", "b c", "d e"}},
+		{command: `a\ b`, words: []string{"a b"}},
+		{command: `'' ""`, words: []string{"", ""}},
+		{command: `pre'quoted'"word"post`, words: []string{"prequotedwordpost"}},
+		{command: `'a\b' 'a"b'`, words: []string{`a\b`, `a"b`}},
+		{command: `"a\"b" "a\\b" "a\$b" "a\b"`, words: []string{`a"b`, `a\b`, `a$b`, `a\b`}},
+		{command: "a \\\n b", words: []string{"a", "b"}},
+		{command: `"a;b" 'c|d' e\&f`, words: []string{"a;b", "c|d", "e&f"}},
+		{command: "a; b", fails: true},
+		{command: "a && b", fails: true},
+		{command: "a | b", fails: true},
+		{command: "a > b", fails: true},
+		{command: "echo $(id)", fails: true},
+		{command: "echo `id`", fails: true},
+		{command: `"abc`, fails: true},
+		{command: `'abc`, fails: true},
+		{command: `abc\`, fails: true},
+	}
+
+	for _, test := range tests {
+		words, err := shellsplit(test.command)
+		if test.fails {
+			if err == nil {
+				t.Errorf("shellsplit(%q) = %q, expected an error", test.command, words)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("shellsplit(%q) failed: %s", test.command, err)
+			continue
+		}
+		if !reflect.DeepEqual(words, test.words) {
+			t.Errorf("shellsplit(%q) = %q, expected %q", test.command, words, test.words)
+		}
+	}
+}
+
+func TestRestrict(t *testing.T) {
+	tests := []struct {
+		args   []string
+		result []string
+		fails  bool
+	}{
+		{args: []string{"version", "-verbose"}, result: []string{"version", "-verbose"}},
+		{args: []string{"metadata", "-date", "123"}, result: []string{"metadata", "-name", "client", "-date", "123"}},
+		{args: []string{"data", "-name", "other", "-n", "other", "-date", "123"}, result: []string{"data", "-name", "client", "-date", "123"}},
+		{args: []string{"data", "--name=other", "-n=other", "file"}, result: []string{"data", "-name", "client", "file"}},
+		{args: []string{"timeline", "-config", "/tmp/evil.conf", "-c=/tmp/evil.conf"}, result: []string{"timeline", "-name", "client"}},
+		{args: []string{"timeline", "-profile", "other", "-P=other"}, result: []string{"timeline", "-name", "client"}},
+		{args: []string{"catfile", "-localvault", "/", "-localvault=/", "file"}, result: []string{"catfile", "-name", "client", "file"}},
+		{args: []string{"newbackup", "-force", "-F", "--force=true", "-date", "123"}, result: []string{"newbackup", "-name", "client", "-date", "123"}},
+		{args: nil, fails: true},
+		{args: []string{"dbcheck"}, fails: true},
+		{args: []string{"sshexec", "id"}, fails: true},
+	}
+
+	for _, test := range tests {
+		result, err := restrict("client", test.args)
+		if test.fails {
+			if err == nil {
+				t.Errorf("restrict(%q) = %q, expected an error", test.args, result)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("restrict(%q) failed: %s", test.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, test.result) {
+			t.Errorf("restrict(%q) = %q, expected %q", test.args, result, test.result)
+		}
+	}
+}
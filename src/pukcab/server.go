@@ -3,16 +3,19 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha512"
 	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -36,7 +39,11 @@ const (
 func SetupServer() {
 	Setup()
 
-	if cfg.Web != "" {
+	if localvault != "" { // we are the backend of a client's local vault
+		cfg.Server, cfg.User, cfg.Web, cfg.API = "", "", "", ""
+		cfg.Vault, cfg.Catalog = localvault, localvault
+	}
+	if (cfg.Web != "" || cfg.API != "") && !insession {
 		web := remotecommand("web")
 		web.Stdin = nil
 		web.Stdout = nil
@@ -48,6 +55,7 @@ func SetupServer() {
 	}
 	switchuser()
 	failure.SetPrefix("")
+	SendErrorFrames()
 	if sshclient := strings.Split(os.Getenv("SSH_CLIENT"), " "); sshclient[0] != "" {
 		log.Printf("Remote client: ip=%q\n", sshclient[0])
 	}
@@ -61,24 +69,34 @@ func absolute(s string) string {
 }
 
 func newbackup() {
+	requested := BackupID(0)
 	flag.StringVar(&name, "name", "", "Backup name")
 	flag.StringVar(&name, "n", "", "-name")
 	flag.StringVar(&schedule, "schedule", "", "IGNORED") // kept for compatibility with older clients
 	flag.StringVar(&schedule, "r", "", "-schedule")
 	flag.BoolVar(&full, "full", full, "Full backup")
 	flag.BoolVar(&full, "f", full, "-full")
+	flag.Var(&requested, "date", "Backup date (to store archives)")
+	flag.Var(&requested, "d", "-date")
+	flag.StringVar(&label, "label", "", "Backup label")
+	flag.StringVar(&comment, "comment", "", "Backup comment")
 
 	SetupServer()
 	cfg.ServerOnly()
 
 	if name == "" {
-		fmt.Println(0)
-		failure.Println("Missing backup name")
-		log.Fatal("Client did not provide a backup name")
+		nobackup("Missing backup name")
+		fatal("Client did not provide a backup name")
+	}
+	cfg.UseClient(name)
+
+	if schedule != "" && schedule != "auto" && !cfg.Allowed(schedule) {
+		nobackup("Schedule not allowed")
+		LogExit(fmt.Errorf("Schedule %q not allowed for %s", schedule, name))
 	}
 
 	if err := opencatalog(); err != nil {
-		fmt.Println(0)
+		nobackup(err.Error())
 		LogExit(err)
 	}
 
@@ -93,21 +111,64 @@ func newbackup() {
 	if backups := Backups(repository, name, "*"); len(backups) > 0 {
 		for _, b := range backups {
 			if time.Since(b.LastModified).Hours() < 1 && !force { // a backup was modified less than 1 hour ago
-				failure.Println("Another backup is already running")
+				nobackup("Another backup is already running")
 				LogExit(errors.New("Another backup is already running"))
 			}
 		}
 	}
 
+	if cfg.quota > 0 {
+		if _, size := storeddata(repository, name); size >= cfg.quota {
+			nobackup("Quota exceeded")
+			LogExit(fmt.Errorf("Backups of %s exceed quota (%d >= %d)", name, size, cfg.quota))
+		}
+	}
+
+	// Don't accept backups too close to each other (unless forced)
+	if cfg.interval > 0 && !force {
+		when := time.Now()
+		if requested > 0 {
+			when = requested.Time()
+		}
+		if last := Last(Finished(Backups(repository, name, "*"))); last.Date != 0 && when.Sub(last.Date.Time()) < cfg.interval {
+			if protocol > 1 {
+				fmt.Fprint(cmdout, JSON(NewBackupReply{
+					Protocol: protocol,
+					Error:    "Too soon after previous backup",
+					Skipped:  true,
+				}))
+			} else {
+				nobackup("Too soon after previous backup")
+			}
+			log.Printf("Skipping backup: name=%q previous=%d interval=%q\n", name, last.Date, cfg.Interval)
+			exit(exitSkipped)
+		}
+	}
+
+	// Backups of a given name must be stored in chronological order
+	if requested > 0 {
+		if last := Last(Backups(repository, name, "*")); last.Date >= requested {
+			nobackup("More recent backups already exist")
+			LogExit(fmt.Errorf("Backup date %d is older than existing backup %d", requested, last.Date))
+		}
+	}
+
 	// Generate and record a new backup ID
 	if err := retry(cfg.Maxtries, func() error {
 		date = BackupID(time.Now().Unix())
+		if requested > 0 {
+			date = requested
+		}
 		schedule = reschedule(date, name, schedule)
+		if !cfg.Allowed(schedule) {
+			schedule = cfg.allowed[0]
+		}
 		if git.Valid(repository.Reference(date.String())) { // this backup ID already exists
 			return errors.New("Duplicate backup ID")
 		}
 		return repository.TagBranch(name, date.String())
 	}); err != nil {
+		nobackup(err.Error())
 		LogExit(err)
 	}
 
@@ -119,7 +180,7 @@ func newbackup() {
 		LogExit(err)
 	}
 	manifest := git.Manifest{}
-	scanner := bufio.NewScanner(os.Stdin)
+	scanner := bufio.NewScanner(cmdin)
 	for scanner.Scan() {
 		f, err := strconv.Unquote(scanner.Text())
 		if err != nil {
@@ -130,7 +191,9 @@ func newbackup() {
 	}
 
 	// report new backup ID
-	fmt.Println(date)
+	if protocol < 2 {
+		fmt.Fprintln(cmdout, date)
+	}
 
 	if !full {
 		if previous := repository.Reference(name); git.Valid(previous) {
@@ -142,20 +205,47 @@ func newbackup() {
 			})
 		}
 	}
-	_, err = repository.CommitToBranch(name, manifest, git.BlameMe(), git.BlameMe(), "New backup\n")
+	_, err = repository.CommitToBranch(name, manifest, git.BlameMe(), git.BlameMe(), "New backup\n"+annotation(schedule, label, comment))
 	if err != nil {
 		LogExit(err)
 	}
 	repository.TagBranch(name, date.String())
 
 	// Find the most recent complete backup for this client
-	if previous := Last(Finished(Backups(repository, name, "*"))); !previous.Finished.IsZero() {
-		fmt.Println(previous.Date)
+	previous := Last(Finished(Backups(repository, name, "*")))
+	if protocol > 1 {
+		fmt.Fprint(cmdout, JSON(NewBackupReply{
+			Protocol:     protocol,
+			Capabilities: capabilities,
+			Date:         date,
+			Previous:     previous.Date, // 0 if no previous backup
+		}))
 	} else {
-		fmt.Println(0) // no previous backup
+		fmt.Fprintln(cmdout, previous.Date) // 0 if no previous backup
 	}
 }
 
+// nobackup reports that a new backup set could not be created
+func nobackup(msg string) {
+	failure.Println(msg)
+	if protocol > 1 {
+		fmt.Fprint(cmdout, JSON(NewBackupReply{
+			Protocol: protocol,
+			Error:    msg,
+		}))
+	} else {
+		fmt.Fprintln(cmdout, 0)
+	}
+}
+
+// annotation records the schedule, label and comment of an unfinished backup in its commit message
+func annotation(schedule, label, comment string) string {
+	if schedule == "" && label == "" && comment == "" {
+		return ""
+	}
+	return "\n" + JSON(BackupMeta{Schedule: schedule, Label: label, Comment: comment})
+}
+
 func dumpcatalog(what dumpflags) {
 	details := what&FullDetails != 0
 	date = 0
@@ -183,7 +273,7 @@ func dumpcatalog(what dumpflags) {
 	}
 	//namefilter := ConvertGlob("names.name", depth, filter...)
 
-	tw := tar.NewWriter(os.Stdout)
+	tw := tar.NewWriter(cmdout)
 	defer tw.Close()
 
 	backups := Backups(repository, name, schedule)
@@ -205,8 +295,7 @@ func dumpcatalog(what dumpflags) {
 	for _, backup := range backups {
 		var header bytes.Buffer
 		if what&Data == 0 {
-			enc := gob.NewEncoder(&header)
-			enc.Encode(BackupInfo{
+			info := BackupInfo{
 				Date:         backup.Date,
 				Finished:     backup.Finished,
 				LastModified: backup.LastModified,
@@ -214,16 +303,27 @@ func dumpcatalog(what dumpflags) {
 				Schedule:     backup.Schedule,
 				Files:        backup.Files,
 				Size:         backup.Size,
-			})
+				Pinned:       backup.Pinned,
+				Label:        backup.Label,
+				Comment:      backup.Comment,
+			}
+			if Capable(capJSON) {
+				header.WriteString(JSON(info))
+			} else {
+				enc := gob.NewEncoder(&header)
+				enc.Encode(info)
+			}
 
 			globalhdr := &tar.Header{
 				Name:     backup.Name,
 				Linkname: backup.Schedule,
 				ModTime:  time.Unix(int64(backup.Date), 0),
-				Uid:      int(backup.Finished.Unix()),
 				Typeflag: tar.TypeXGlobalHeader,
 				Size:     int64(header.Len()),
 			}
+			if protocol < 2 {
+				globalhdr.Uid = int(backup.Finished.Unix())
+			}
 			tw.WriteHeader(globalhdr)
 			tw.Write(header.Bytes())
 		}
@@ -250,6 +350,9 @@ func dumpcatalog(what dumpflags) {
 													if data, err := repository.Get(ref, dataname(realname(path))); err == nil {
 														hdr.Xattrs["backup.hash"] = string(data.ID())
 													}
+													if meta.Digest != "" {
+														hdr.Xattrs["backup.sha512"] = meta.Digest
+													}
 												}
 											} else {
 												if hdr.Typeflag == tar.TypeReg {
@@ -302,6 +405,58 @@ func timeline() {
 	dumpcatalog(FullDetails | Reverse)
 }
 
+// catfile streams the contents of regular files from the most recent backup set before a given date
+func catfile() {
+	date.Set("now")
+	flag.StringVar(&name, "name", "", "Backup name")
+	flag.StringVar(&name, "n", "", "-name")
+	flag.Var(&date, "date", "Backup set")
+	flag.Var(&date, "d", "-date")
+
+	SetupServer()
+	cfg.ServerOnly()
+
+	if name == "" {
+		failure.Println("Missing backup name")
+		fatal("Client did not provide a backup name")
+	}
+
+	if err := opencatalog(); err != nil {
+		LogExit(err)
+	}
+
+	backups := Before(date, Backups(repository, name, "*"))
+	if len(backups) == 0 {
+		failure.Printf("Unknown backup set date=%d\n", date)
+		fatalf("Reading file: date=%d name=%q error=fatal msg=\"unknown backup\"\n", date, name)
+	}
+	backup := Last(backups)
+
+	ref := repository.Reference(backup.Date.String())
+	for _, f := range flag.Args() {
+		f = path.Join("/", f)
+		data, err := repository.Get(ref, dataname(f))
+		if err != nil {
+			failure.Println("No such file:", f)
+			fatalf("Reading file: date=%d name=%q file=%q error=fatal msg=\"no such file\"\n", backup.Date, name, f)
+		}
+		blob, ok := data.(git.Blob)
+		if !ok {
+			failure.Println("Not a regular file:", f)
+			fatalf("Reading file: date=%d name=%q file=%q error=fatal msg=\"not a regular file\"\n", backup.Date, name, f)
+		}
+		reader, err := blob.Open()
+		if err != nil {
+			LogExit(err)
+		}
+		_, err = io.Copy(cmdout, reader)
+		reader.Close()
+		if err != nil {
+			LogExit(err)
+		}
+	}
+}
+
 func toascii(s string) (result string) {
 	for i := 0; i < len(s); i++ {
 		if s[i] > ' ' && s[i] < 0x80 {
@@ -313,13 +468,22 @@ func toascii(s string) (result string) {
 
 type TarReader struct {
 	tar.Reader
-	size int64
+	size   int64
+	digest hash.Hash
 }
 
 func (tr *TarReader) Size() (int64, error) {
 	return tr.size, nil
 }
 
+func (tr *TarReader) Read(b []byte) (n int, err error) {
+	n, err = tr.Reader.Read(b)
+	if tr.digest != nil {
+		tr.digest.Write(b[:n])
+	}
+	return
+}
+
 func submitfiles() {
 	flag.StringVar(&name, "name", "", "Backup name")
 	flag.StringVar(&name, "n", "", "-name")
@@ -333,17 +497,18 @@ func submitfiles() {
 
 	if name == "" {
 		failure.Println("Missing backup name")
-		log.Fatal("Client did not provide a backup name")
+		fatal("Client did not provide a backup name")
 	}
 
-	if IsATTY(os.Stdout) {
+	if IsATTY(cmdout) {
 		failure.Println("Should not be called directly")
-		log.Fatal("Should not be called directly")
+		fatal("Should not be called directly")
 	}
 
 	if err := opencatalog(); err != nil {
 		LogExit(err)
 	}
+	cfg.UseClient(name)
 
 	started := time.Now()
 
@@ -353,17 +518,31 @@ func submitfiles() {
 	}
 	if !Get(date, backups).Finished.IsZero() {
 		failure.Printf("Error: backup set date=%d is already complete\n", date)
-		log.Fatalf("Error: backup set date=%d is already complete\n", date)
+		fatalf("Error: backup set date=%d is already complete\n", date)
 	}
 
 	files, missing := countfiles(repository, date)
-	schedule = reschedule(date, name, schedule)
+	pending := Get(date, backups)
+	if pending.Schedule != "" { // decided by newbackup
+		schedule = pending.Schedule
+	} else {
+		schedule = reschedule(date, name, schedule)
+		if !cfg.Allowed(schedule) {
+			schedule = cfg.allowed[0]
+		}
+	}
 
 	log.Printf("Receiving files for backup set: date=%d name=%q schedule=%q files=%d missing=%d\n", date, name, schedule, files, missing)
 
+	var stored map[git.ID]bool
+	var size int64
+	if cfg.quota > 0 {
+		stored, size = storeddata(repository, name)
+	}
+
 	manifest := git.Manifest{}
 	var received int64
-	tr := tar.NewReader(os.Stdin)
+	tr := tar.NewReader(cmdin)
 
 	for {
 		hdr, err := tr.Next()
@@ -390,24 +569,34 @@ func submitfiles() {
 				hdr.ChangeTime = time.Unix(0, 0)
 			}
 
-			if meta, err := repository.NewBlob(bytes.NewReader([]byte(JSON(HeaderMeta(hdr))))); err == nil {
-				manifest[metaname(hdr.Name)] = git.File(meta)
-			} else {
-				LogExit(err)
-			}
-
+			meta := HeaderMeta(hdr)
 			switch hdr.Typeflag {
 			case tar.TypeReg, tar.TypeRegA:
+				digest := sha512.New()
 				blob, err := repository.NewBlob(&TarReader{
 					Reader: *tr,
 					size:   hdr.Size,
+					digest: digest,
 				})
 				if err != nil {
 					LogExit(err)
 				}
 				received += hdr.Size
+				if cfg.quota > 0 && !stored[blob.ID()] { // only new data counts
+					stored[blob.ID()] = true
+					if size += hdr.Size; size > cfg.quota {
+						failure.Println("Quota exceeded")
+						LogExit(fmt.Errorf("Backups of %s exceed quota (%d > %d)", name, size, cfg.quota))
+					}
+				}
 				manifest[dataname(hdr.Name)] = git.File(blob)
+				meta.Digest = fmt.Sprintf("%x", digest.Sum(nil))
+			}
 
+			if metablob, err := repository.NewBlob(bytes.NewReader([]byte(JSON(meta)))); err == nil {
+				manifest[metaname(hdr.Name)] = git.File(metablob)
+			} else {
+				LogExit(err)
 			}
 		}
 	}
@@ -420,7 +609,7 @@ func submitfiles() {
 			return nil
 		})
 	}
-	commit, err := repository.CommitToBranch(name, manifest, git.BlameMe(), git.BlameMe(), "Submit files\n")
+	commit, err := repository.CommitToBranch(name, manifest, git.BlameMe(), git.BlameMe(), "Submit files\n"+annotation(schedule, pending.Label, pending.Comment))
 	if err != nil {
 		LogExit(err)
 	}
@@ -438,14 +627,28 @@ func submitfiles() {
 				Files:    files,
 				Size:     received,
 				Finished: time.Now().Unix(),
+				Label:    pending.Label,
+				Comment:  pending.Comment,
 				// note: LastModified is 0
 			}))
 
 		log.Printf("Finished backup: date=%d name=%q schedule=%q files=%d received=%d duration=%.0f elapsed=%.0f\n", date, name, schedule, files, received, time.Since(started).Seconds(), time.Since(time.Unix(int64(date), 0)).Seconds())
-		fmt.Printf("Backup %d complete (%d files)\n", date, files)
 	} else {
 		log.Printf("Received files for backup set: date=%d name=%q schedule=%q files=%d missing=%d received=%d duration=%.0f\n", date, name, schedule, files, missing, received, time.Since(started).Seconds())
-		fmt.Printf("Received %d files for backup %d (%d files to go)\n", files-missing, date, missing)
+	}
+
+	switch {
+	case Capable(capJSON):
+		fmt.Fprint(cmdout, JSON(SubmitReply{
+			Date:     date,
+			Files:    files,
+			Missing:  missing,
+			Complete: missing == 0,
+		}))
+	case missing == 0:
+		fmt.Fprintf(cmdout, "Backup %d complete (%d files)\n", date, files)
+	default:
+		fmt.Fprintf(cmdout, "Received %d files for backup %d (%d files to go)\n", files-missing, date, missing)
 	}
 }
 
@@ -461,20 +664,27 @@ func purgebackup() {
 
 	if name == "" {
 		failure.Println("Missing backup name")
-		log.Fatal("Client did not provide a backup name")
+		fatal("Client did not provide a backup name")
 	}
 
 	if date == -1 && !force {
 		failure.Println("Missing backup date")
-		log.Fatal("Client did not provide a backup date")
+		fatal("Client did not provide a backup date")
 	}
 
 	if err := opencatalog(); err != nil {
 		LogExit(err)
 	}
 
+	pinned := false
 	for _, backup := range Backups(repository, name, "*") {
 		if date == -1 || backup.Date == date {
+			if backup.Pinned {
+				pinned = true
+				failure.Printf("Error: backup set date=%d is pinned\n", backup.Date)
+				log.Printf("Deleting backup: date=%d name=%q error=warn msg=\"pinned\"\n", backup.Date, backup.Name)
+				continue
+			}
 			if err := repository.UnTag(backup.Date.String()); err != nil {
 				failure.Printf("Error: could not delete backup set date=%d\n", backup.Date)
 				log.Printf("Deleting backup: date=%d name=%q error=warn msg=%q\n", backup.Date, backup.Name, err)
@@ -483,88 +693,299 @@ func purgebackup() {
 			}
 		}
 	}
+	if pinned {
+		exit(1)
+	}
+}
+
+// retag updates the metadata stored in the tag of a complete backup
+func retag(date BackupID, update func(*BackupMeta)) error {
+	ref := repository.Reference(date.String())
+	if !git.Valid(ref) {
+		return fmt.Errorf("Unknown backup %d", date)
+	}
+	obj, err := repository.Object(ref)
+	if err != nil {
+		return err
+	}
+	tag, ok := obj.(git.Tag)
+	if !ok {
+		return fmt.Errorf("Backup %d is not complete", date)
+	}
+
+	var meta BackupMeta
+	if err := json.Unmarshal([]byte(tag.Text()), &meta); err != nil {
+		return err
+	}
+	update(&meta)
+
+	// the tag keeps pointing to the same commit
+	commit, err := repository.Object(tag.Target())
+	if err != nil {
+		return err
+	}
+	if err := repository.UnTag(date.String()); err != nil {
+		return err
+	}
+	_, err = repository.NewTag(date.String(), commit.ID(), commit.Type(), git.BlameMe(), JSON(meta))
+	return err
+}
+
+func annotatebackup() {
+	flag.StringVar(&name, "name", "", "Backup name")
+	flag.StringVar(&name, "n", "", "-name")
+	flag.Var(&date, "date", "Backup set")
+	flag.Var(&date, "d", "-date")
+	flag.StringVar(&label, "label", "", "Backup label")
+	flag.StringVar(&comment, "comment", "", "Backup comment")
+
+	SetupServer()
+	cfg.ServerOnly()
+
+	if name == "" {
+		failure.Println("Missing backup name")
+		fatal("Client did not provide a backup name")
+	}
+	if date <= 0 {
+		failure.Println("Missing backup date")
+		fatal("Client did not provide a backup date")
+	}
+
+	setlabel, setcomment := false, false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "label":
+			setlabel = true
+		case "comment":
+			setcomment = true
+		}
+	})
+
+	if err := opencatalog(); err != nil {
+		LogExit(err)
+	}
+
+	backup := Get(date, Backups(repository, name, "*"))
+	if backup.Date == 0 {
+		failure.Printf("Unknown backup set date=%d\n", date)
+		fatalf("Annotating backup: date=%d name=%q error=fatal msg=\"unknown backup\"\n", date, name)
+	}
+
+	if err := retag(backup.Date, func(meta *BackupMeta) {
+		if setlabel {
+			meta.Label = label
+		}
+		if setcomment {
+			meta.Comment = comment
+		}
+	}); err != nil {
+		failure.Println(err)
+		fatalf("Annotating backup: date=%d name=%q error=fatal msg=%q\n", backup.Date, name, err)
+	}
+	log.Printf("Annotated backup: date=%d name=%q label=%q comment=%q\n", backup.Date, name, label, comment)
+}
+
+func pinbackup() {
+	unpin := false
+	flag.StringVar(&name, "name", "", "Backup name")
+	flag.StringVar(&name, "n", "", "-name")
+	flag.Var(&date, "date", "Backup set")
+	flag.Var(&date, "d", "-date")
+	flag.BoolVar(&unpin, "unpin", unpin, "Unpin the backup")
+
+	SetupServer()
+	cfg.ServerOnly()
+
+	if name == "" {
+		failure.Println("Missing backup name")
+		fatal("Client did not provide a backup name")
+	}
+	if date <= 0 {
+		failure.Println("Missing backup date")
+		fatal("Client did not provide a backup date")
+	}
+
+	if err := opencatalog(); err != nil {
+		LogExit(err)
+	}
+
+	backup := Get(date, Backups(repository, name, "*"))
+	if backup.Date == 0 {
+		failure.Printf("Unknown backup set date=%d\n", date)
+		fatalf("Pinning backup: date=%d name=%q error=fatal msg=\"unknown backup\"\n", date, name)
+	}
+
+	if err := retag(backup.Date, func(meta *BackupMeta) { meta.Pinned = !unpin }); err != nil {
+		failure.Println(err)
+		fatalf("Pinning backup: date=%d name=%q error=fatal msg=%q\n", backup.Date, name, err)
+	}
+	if unpin {
+		log.Printf("Unpinned backup: date=%d name=%q\n", backup.Date, name)
+	} else {
+		log.Printf("Pinned backup: date=%d name=%q\n", backup.Date, name)
+	}
 }
 
 func vacuum() {
 	// TODO
 }
 
-func days(val, def int64) int64 {
-	if val > 0 {
-		return val
+// expirefailed decides to delete unfinished backups older than a given date, provided a more recent backup of the same name succeeded
+func expirefailed(plan []Decision, backups []Backup, expdate BackupID) {
+	succeeded := make(map[string]BackupID)
+	for _, b := range backups {
+		if finished(b) && b.Date > succeeded[b.Name] {
+			succeeded[b.Name] = b.Date
+		}
+	}
+
+	for i, d := range plan {
+		if !finished(d.Backup) && d.Date < expdate && d.Date < succeeded[d.Name] {
+			plan[i].Keep, plan[i].Rules = false, []string{"failed"}
+		}
+	}
+}
+
+// expireschedules decides which backups of a client to delete, by schedule and age (clients can't expire backups earlier than the server policy)
+func expireschedules(backups []Backup, schedules string, minimum int, policy *Config) (plan []Decision) {
+	all := schedules == ""
+	if all {
+		schedules = strings.Join(policy.ScheduleNames(), ",")
+	}
+	for _, schedule := range strings.Split(schedules, ",") {
+		expdate := date
+		days := policy.ExpirationDays(schedule)
+		switch {
+		case date == -1 && days <= 0 && all: // don't hold the other schedules
+			log.Printf("Skipping expiration: schedule=%q msg=\"no expiration\" error=warn\n", schedule)
+			continue
+		case date == -1 && days <= 0:
+			failure.Println("Missing expiration")
+			fatal("Client did not provide an expiration")
+		case days > 0 && (date == -1 || BackupID(time.Now().Unix()-days*24*60*60) < expdate):
+			expdate = BackupID(time.Now().Unix() - days*24*60*60)
+		}
+
+		list := Filter("", schedule, backups)
+		if len(list) == 0 {
+			continue
+		}
+		log.Printf("Expiring backups: name=%q schedule=%q date=%d (%v)\n", list[0].Name, schedule, expdate, time.Unix(int64(expdate), 0))
+		for i, backup := range list {
+			remaining := 0
+			for j := i; j < len(list); j++ {
+				if list[j].Date >= expdate {
+					remaining++
+				}
+			}
+			decision := Decision{Backup: backup, Keep: true}
+			switch {
+			case backup.Date >= expdate:
+				decision.Rules = []string{"age"}
+			case remaining < minimum:
+				decision.Rules = []string{"minimum"}
+			default:
+				decision.Keep = false
+			}
+			plan = append(plan, decision)
+		}
 	}
-	return def
+	return
 }
 
 func expirebackup() {
 	schedules := ""
 	keep := 3
+	planonly := false
 	flag.StringVar(&name, "name", "", "Backup name")
 	flag.StringVar(&name, "n", "", "-name")
-	flag.StringVar(&schedules, "schedule", defaultSchedule, "Backup schedule")
-	flag.StringVar(&schedules, "r", defaultSchedule, "-schedule")
+	flag.StringVar(&schedules, "schedule", "", "Backup schedules (default: all)")
+	flag.StringVar(&schedules, "r", "", "-schedule")
 	flag.IntVar(&keep, "keep", keep, "Minimum number of backups to keep")
 	flag.IntVar(&keep, "k", keep, "-keep")
 	flag.Var(&date, "age", "Maximum age/date")
 	flag.Var(&date, "a", "-age")
 	flag.Var(&date, "date", "-age")
 	flag.Var(&date, "d", "-age")
+	flag.BoolVar(&planonly, "plan", planonly, "Only show which backups would be kept or deleted")
 
 	SetupServer()
 	cfg.ServerOnly()
 
-	if schedules == "" {
-		failure.Println("Missing backup schedule")
-		log.Fatal("Client did not provide a backup schedule")
-	}
-
 	if err := opencatalog(); err != nil {
 		LogExit(err)
 	}
 
-	for _, schedule = range strings.Split(schedules, ",") {
-		expdate := date
-		if date == -1 {
-			switch schedule {
-			case "daily":
-				expdate = BackupID(time.Now().Unix() - days(cfg.Expiration.Daily, 2*7)*24*60*60) // 2 weeks
-			case "weekly":
-				expdate = BackupID(time.Now().Unix() - days(cfg.Expiration.Weekly, 6*7)*24*60*60) // 6 weeks
-			case "monthly":
-				expdate = BackupID(time.Now().Unix() - days(cfg.Expiration.Monthly, 365)*24*60*60) // 1 year
-			case "yearly":
-				expdate = BackupID(time.Now().Unix() - days(cfg.Expiration.Yearly, 10*365)*24*60*60) // 10 years
-			default:
-				failure.Println("Missing expiration")
-				log.Fatal("Client did not provide an expiration")
-			}
+	clients := make(map[string][]Backup)
+	names := []string{}
+	for _, backup := range Backups(repository, name, "*") {
+		if _, ok := clients[backup.Name]; !ok {
+			names = append(names, backup.Name)
+		}
+		clients[backup.Name] = append(clients[backup.Name], backup)
+	}
+	sort.Strings(names)
+
+	plan := []Decision{}
+	for _, n := range names {
+		policy := cfg
+		policy.UseClient(n) // the server policy for this client can't be shortened
+		minimum := keep
+		if policy.Keep > minimum {
+			minimum = policy.Keep
 		}
 
-		log.Printf("Expiring backups: name=%q schedule=%q date=%d (%v)\n", name, schedule, expdate, time.Unix(int64(expdate), 0))
-		backups := Backups(repository, name, schedule)
-		for i, backup := range backups {
-			remaining := 0
-			for j := i; j < len(backups); j++ {
-				if backups[j].Name == backup.Name && backups[j].Date >= expdate {
-					remaining++
+		decisions := []Decision{}
+		if policy.Retention.Enabled() {
+			log.Printf("Expiring backups: name=%q retention=\"%d/%d/%d/%d\"\n", n, policy.Retention.Daily, policy.Retention.Weekly, policy.Retention.Monthly, policy.Retention.Yearly)
+			decisions = Policy{Retention: policy.Retention, Expiration: policy.Expiration, Minimum: minimum}.Plan(clients[n], time.Now())
+			for i := range decisions {
+				if date != -1 && decisions[i].Date >= date && !decisions[i].Keep { // clients may keep backups longer
+					decisions[i].Keep, decisions[i].Rules = true, []string{"age"}
 				}
 			}
-			if remaining >= keep && backup.Date < expdate {
-				if err := repository.UnTag(backup.Date.String()); err != nil {
-					failure.Printf("Error: could not delete backup set date=%d\n", backup.Date)
-					log.Printf("Deleting backup: date=%d name=%q error=warn msg=%q\n", backup.Date, backup.Name, err)
-				} else {
-					log.Printf("Deleted backup: date=%d name=%q\n", backup.Date, backup.Name)
-				}
+		} else {
+			decisions = expireschedules(clients[n], schedules, minimum, &policy)
+		}
+
+		failed := policy.Expiration.Failed
+		if failed == 0 {
+			failed = defaultFailed
+		}
+		if failed > 0 {
+			expirefailed(decisions, clients[n], BackupID(time.Now().Unix()-failed*24*60*60))
+		}
+		for i := range decisions {
+			if decisions[i].Pinned {
+				decisions[i].Keep, decisions[i].Rules = true, append(decisions[i].Rules, "pinned")
+			}
+		}
+		plan = append(plan, decisions...)
+	}
+
+	for _, decision := range plan {
+		if planonly {
+			fmt.Fprintln(cmdout, decision)
+			continue
+		}
+		if !decision.Keep {
+			if err := repository.UnTag(decision.Date.String()); err != nil {
+				failure.Printf("Error: could not delete backup set date=%d\n", decision.Date)
+				log.Printf("Deleting backup: date=%d name=%q error=warn msg=%q\n", decision.Date, decision.Name, err)
+			} else {
+				log.Printf("Deleted backup: date=%d name=%q\n", decision.Date, decision.Name)
 			}
 		}
 	}
 
+	if planonly {
+		return
+	}
 	vacuum()
 }
 
 func printstats(name string, stat *syscall.Statfs_t) {
-	fmt.Printf("%-10s\t%s\t%s\t%s\t%.0f%%\t%s\n", Fstype(uint64(stat.Type)), Bytes(uint64(stat.Bsize)*stat.Blocks), Bytes(uint64(stat.Bsize)*(stat.Blocks-stat.Bavail)), Bytes(uint64(stat.Bsize)*stat.Bavail), 100-100*float32(stat.Bavail)/float32(stat.Blocks), name)
+	fmt.Fprintf(cmdout, "%-10s\t%s\t%s\t%s\t%.0f%%\t%s\n", Fstype(uint64(stat.Type)), Bytes(uint64(stat.Bsize)*stat.Blocks), Bytes(uint64(stat.Bsize)*(stat.Blocks-stat.Bavail)), Bytes(uint64(stat.Bsize)*stat.Bavail), 100-100*float32(stat.Bavail)/float32(stat.Blocks), name)
 }
 
 func df() {
@@ -583,7 +1004,7 @@ func df() {
 		LogExit(err)
 	}
 
-	fmt.Println("Filesystem\tSize\tUsed\tAvail\tUse%\tMounted on")
+	fmt.Fprintln(cmdout, "Filesystem\tSize\tUsed\tAvail\tUse%\tMounted on")
 	if cstat.Fsid == vstat.Fsid {
 		printstats("catalog,vault", &cstat)
 	} else {
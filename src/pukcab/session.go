@@ -0,0 +1,938 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// frame types (a frame is made of its type, a stream ID, the length of the payload and the payload)
+const (
+	frameRequest = 'R' // client: start a stream, the payload is the JSON-encoded command line
+	frameStdin   = 'I' // client: standard input of the command (an empty payload closes it)
+	frameStdout  = 'O' // server: standard output of the command
+	frameStderr  = 'E' // server: standard error of the command
+	frameExit    = 'X' // server: the command has exited, the payload is its exit status
+	frameWindow  = 'W' // both: the receiver consumed data, the payload is the frame type of the data and a byte count
+)
+
+const maxFrameSize = 1 << 20
+const chunkSize = 32 * 1024
+const windowSize = 256 * 1024 // unconsumed data allowed per stream and direction
+
+var errSessionClosed = errors.New("Session closed")
+var errWindowExceeded = errors.New("Window exceeded")
+
+// frameconn reads and writes frames on a connection
+type frameconn struct {
+	r  *bufio.Reader
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func (f *frameconn) WriteFrame(kind byte, id uint32, payload []byte) error {
+	var header [9]byte
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:5], id)
+	binary.BigEndian.PutUint32(header[5:9], uint32(len(payload)))
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := f.w.Write(payload); err != nil {
+		return err
+	}
+	if flusher, ok := f.w.(interface{ Flush() error }); ok { // compressed stream
+		return flusher.Flush()
+	}
+	return nil
+}
+
+func (f *frameconn) ReadFrame() (kind byte, id uint32, payload []byte, err error) {
+	var header [9]byte
+	if _, err = io.ReadFull(f.r, header[:]); err != nil {
+		return
+	}
+	kind = header[0]
+	id = binary.BigEndian.Uint32(header[1:5])
+	size := binary.BigEndian.Uint32(header[5:9])
+	if size > maxFrameSize {
+		err = errors.New("Frame too large")
+		return
+	}
+	payload = make([]byte, size)
+	_, err = io.ReadFull(f.r, payload)
+	return
+}
+
+// Send writes data as frames, waiting for the receiver to make room for it
+func (f *frameconn) Send(kind byte, id uint32, data []byte, w *window) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		if n = w.take(n); n == 0 {
+			return errSessionClosed
+		}
+		if err := f.WriteFrame(kind, id, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// Grant tells the sender that data has been consumed
+func (f *frameconn) Grant(kind byte, id uint32, n int) {
+	var payload [5]byte
+	payload[0] = kind
+	binary.BigEndian.PutUint32(payload[1:5], uint32(n))
+	f.WriteFrame(frameWindow, id, payload[:])
+}
+
+// parsewindow decodes the payload of a window frame
+func parsewindow(payload []byte) (kind byte, n int, ok bool) {
+	if len(payload) != 5 {
+		return 0, 0, false
+	}
+	return payload[0], int(binary.BigEndian.Uint32(payload[1:5])), true
+}
+
+// window limits the data sent on a stream but not yet consumed by the receiver (so that a slow
+// reader blocks its command without holding the other streams)
+type window struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	credit int
+	closed bool
+}
+
+func newwindow() *window {
+	w := &window{credit: windowSize}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// take waits until up to n bytes can be sent (returns 0 once the window is closed)
+func (w *window) take(n int) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.credit == 0 && !w.closed {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return 0
+	}
+	if n > w.credit {
+		n = w.credit
+	}
+	w.credit -= n
+	return n
+}
+
+func (w *window) grant(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.credit += n
+	w.cond.Broadcast()
+}
+
+func (w *window) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	w.cond.Broadcast()
+}
+
+// streamwriter sends what is written to it as frames of a stream
+type streamwriter struct {
+	conn   *frameconn
+	kind   byte
+	id     uint32
+	window *window
+}
+
+func (w *streamwriter) Write(p []byte) (int, error) {
+	if err := w.conn.Send(w.kind, w.id, p, w.window); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// buffer is a pipe which holds up to windowSize bytes (so that a slow reader doesn't block other streams)
+type buffer struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	chunks   [][]byte
+	size     int
+	err      error
+	consumed func(int)
+}
+
+func newbuffer(consumed func(int)) *buffer {
+	b := &buffer{consumed: consumed}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *buffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.size+len(p) > windowSize { // the sender ignored the window
+		return 0, errWindowExceeded
+	}
+	b.chunks = append(b.chunks, append([]byte(nil), p...))
+	b.size += len(p)
+	b.cond.Signal()
+	return len(p), nil
+}
+
+func (b *buffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	for len(b.chunks) == 0 && b.err == nil {
+		b.cond.Wait()
+	}
+	if len(b.chunks) == 0 {
+		b.mu.Unlock()
+		return 0, b.err
+	}
+	n := copy(p, b.chunks[0])
+	if n < len(b.chunks[0]) {
+		b.chunks[0] = b.chunks[0][n:]
+	} else {
+		b.chunks = b.chunks[1:]
+	}
+	b.size -= n
+	b.mu.Unlock()
+
+	if b.consumed != nil {
+		b.consumed(n)
+	}
+	return n, nil
+}
+
+// CloseWithError makes further reads fail once buffered data has been read
+func (b *buffer) CloseWithError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.cond.Broadcast()
+}
+
+func (b *buffer) Close() error {
+	b.CloseWithError(io.EOF)
+	return nil
+}
+
+// Session is the client side of a multiplexed session: a single server process ("pukcab session")
+// which runs several commands (streams) over one connection
+type Session struct {
+	conn    *frameconn
+	cmd     *Command
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	next    uint32
+	err     error
+	done    chan struct{}
+}
+
+var activesession *Session
+var sessionmu sync.Mutex
+
+// Stream is a command running in a session
+type Stream struct {
+	session *Session
+	id      uint32
+	args    []string
+
+	stdin  io.Reader
+	window *window
+	stdout *buffer
+	stderr *buffer
+	piped  bool
+	done   chan struct{}
+	once   sync.Once
+	copied sync.WaitGroup
+	status int
+	err    error
+}
+
+// UseSession runs the following server commands through a single multiplexed session (if the server supports it)
+func UseSession() {
+	if cfg.Server == "" || ishttp() || isvault() || currentsession() != nil {
+		return
+	}
+	negotiate()
+	if !Capable(capSession) {
+		return
+	}
+
+	cmd := remotecommand("session")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		debug.Println("Session:", err)
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		debug.Println("Session:", err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		log.Println(cmd.Args, err)
+		return
+	}
+
+	s := &Session{
+		conn:    &frameconn{r: bufio.NewReader(stdout), w: stdin},
+		cmd:     cmd,
+		streams: make(map[uint32]*Stream),
+		done:    make(chan struct{}),
+	}
+	go s.demux(stdin)
+
+	sessionmu.Lock()
+	activesession = s
+	sessionmu.Unlock()
+	debug.Println("Session started")
+}
+
+// CloseSession terminates the current session (if any)
+func CloseSession() {
+	sessionmu.Lock()
+	s := activesession
+	activesession = nil
+	sessionmu.Unlock()
+
+	if s != nil {
+		if closer, ok := s.conn.w.(io.Closer); ok {
+			closer.Close()
+		}
+		<-s.done
+		s.cmd.Wait()
+	}
+}
+
+func currentsession() *Session {
+	sessionmu.Lock()
+	defer sessionmu.Unlock()
+	if activesession != nil && activesession.failed() {
+		activesession = nil
+	}
+	return activesession
+}
+
+func (s *Session) failed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err != nil
+}
+
+func (s *Session) demux(stdin io.Closer) {
+	var err error
+	for {
+		var kind byte
+		var id uint32
+		var payload []byte
+		if kind, id, payload, err = s.conn.ReadFrame(); err != nil {
+			break
+		}
+
+		s.mu.Lock()
+		stream := s.streams[id]
+		s.mu.Unlock()
+		if stream == nil {
+			continue
+		}
+
+		switch kind {
+		case frameStdout:
+			if _, err := stream.stdout.Write(payload); err != nil {
+				stream.finish(err)
+			}
+		case frameStderr:
+			if _, err := stream.stderr.Write(payload); err != nil {
+				stream.finish(err)
+			}
+		case frameWindow:
+			if kind, n, ok := parsewindow(payload); ok && kind == frameStdin {
+				stream.window.grant(n)
+			}
+		case frameExit:
+			stream.status, _ = strconv.Atoi(string(payload))
+			stream.finish(nil)
+		}
+	}
+
+	if err == io.EOF {
+		err = errSessionClosed
+	}
+	log.Printf("Session ended: msg=%q\n", err)
+	stdin.Close()
+
+	s.mu.Lock()
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	s.mu.Unlock()
+	for _, stream := range streams {
+		stream.finish(err)
+	}
+	close(s.done)
+}
+
+// NewStream prepares a command to be run in a session
+func (s *Session) NewStream(args []string) *Stream {
+	t := &Stream{
+		session: s,
+		args:    args,
+		window:  newwindow(),
+		done:    make(chan struct{}),
+	}
+	t.stdout = newbuffer(func(n int) { s.conn.Grant(frameStdout, t.id, n) })
+	t.stderr = newbuffer(func(n int) { s.conn.Grant(frameStderr, t.id, n) })
+	return t
+}
+
+func (t *Stream) finish(err error) {
+	t.session.mu.Lock()
+	delete(t.session.streams, t.id)
+	t.session.mu.Unlock()
+
+	t.once.Do(func() {
+		t.err = err
+		if err == nil {
+			err = io.EOF
+		}
+		t.window.close()
+		t.stdout.CloseWithError(err)
+		t.stderr.CloseWithError(err)
+		close(t.done)
+	})
+}
+
+// StdinPipe returns a pipe connected to the command's standard input
+func (t *Stream) StdinPipe() (io.WriteCloser, error) {
+	r, w := io.Pipe()
+	t.stdin = r
+	return w, nil
+}
+
+// StdoutPipe returns a pipe connected to the command's standard output
+func (t *Stream) StdoutPipe() (io.ReadCloser, error) {
+	t.piped = true
+	return t.stdout, nil
+}
+
+// Start sends the command to the server
+func (t *Stream) Start(stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	if t.stdin == nil {
+		t.stdin = stdin
+	}
+
+	request, err := json.Marshal(t.args)
+	if err != nil {
+		return err
+	}
+
+	s := t.session
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return s.err
+	}
+	s.next++
+	t.id = s.next
+	s.streams[t.id] = t
+	s.mu.Unlock()
+
+	if err := s.conn.WriteFrame(frameRequest, t.id, request); err != nil {
+		t.finish(err)
+		return err
+	}
+
+	go func() {
+		if t.stdin != nil {
+			chunk := make([]byte, chunkSize)
+			for {
+				n, err := t.stdin.Read(chunk)
+				if n > 0 {
+					if s.conn.Send(frameStdin, t.id, chunk[:n], t.window) != nil {
+						return
+					}
+				}
+				if err != nil {
+					break
+				}
+			}
+		}
+		s.conn.WriteFrame(frameStdin, t.id, nil)
+	}()
+
+	if !t.piped {
+		if stdout == nil {
+			stdout = ioutil.Discard
+		}
+		t.copied.Add(1)
+		go func() {
+			io.Copy(stdout, t.stdout)
+			t.copied.Done()
+		}()
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	t.copied.Add(1)
+	go func() {
+		io.Copy(stderr, t.stderr)
+		t.copied.Done()
+	}()
+
+	return nil
+}
+
+// Wait waits for the command to complete
+func (t *Stream) Wait() error {
+	<-t.done
+	t.copied.Wait()
+	if t.err != nil {
+		return t.err
+	}
+	if t.status != 0 {
+		return &ExitError{Code: t.status}
+	}
+	return nil
+}
+
+// insession is set while a session runs commands in-process
+var insession = false
+
+// sessioncommand returns the server command run in-process for a session request or on a local vault (nil if there is none)
+func sessioncommand(command string) func() {
+	switch command {
+	case "version":
+		return version
+	case "df":
+		return df
+	case "newbackup":
+		return newbackup
+	case "submitfiles":
+		return submitfiles
+	case "metadata":
+		return metadata
+	case "timeline":
+		return timeline
+	case "data":
+		return data
+	case "catfile":
+		return catfile
+	case "purgebackup":
+		return purgebackup
+	case "pinbackup":
+		return pinbackup
+	case "annotatebackup":
+		return annotatebackup
+	case "expirebackup":
+		return expirebackup
+	case "nextjob":
+		return nextjob
+	case "jobstatus":
+		return jobstatus
+	}
+	return nil
+}
+
+// exitcode ends a command run in-process (see exit)
+type exitcode int
+
+// globals holds the state shared by all commands, so that a session can run them in turn
+type globals struct {
+	args                                    []string
+	flags                                   *flag.FlagSet
+	cmdin, cmdout, cmderr                   *os.File
+	failure, info, debug                    *log.Logger
+	exit                                    func(int)
+	cfg                                     Config
+	name, schedule, label, comment, profile string
+	configFile, compression, localvault     string
+	defaultName, defaultSchedule            string
+	date                                    BackupID
+	full, verbose, force, negotiated        bool
+	protocol, timeout                       int
+}
+
+func saveglobals() globals {
+	return globals{
+		args:            os.Args,
+		flags:           flag.CommandLine,
+		cmdin:           cmdin,
+		cmdout:          cmdout,
+		cmderr:          cmderr,
+		failure:         failure,
+		info:            info,
+		debug:           debug,
+		exit:            exit,
+		cfg:             cfg,
+		name:            name,
+		schedule:        schedule,
+		label:           label,
+		comment:         comment,
+		profile:         profile,
+		configFile:      configFile,
+		compression:     compression,
+		localvault:      localvault,
+		defaultName:     defaultName,
+		defaultSchedule: defaultSchedule,
+		date:            date,
+		full:            full,
+		verbose:         verbose,
+		force:           force,
+		negotiated:      negotiated,
+		protocol:        protocol,
+		timeout:         timeout,
+	}
+}
+
+func (g globals) restore() {
+	os.Args, flag.CommandLine = g.args, g.flags
+	cmdin, cmdout, cmderr = g.cmdin, g.cmdout, g.cmderr
+	failure, info, debug, exit = g.failure, g.info, g.debug, g.exit
+	cfg = g.cfg
+	name, schedule, label, comment, profile = g.name, g.schedule, g.label, g.comment, g.profile
+	configFile, compression, localvault = g.configFile, g.compression, g.localvault
+	defaultName, defaultSchedule = g.defaultName, g.defaultSchedule
+	date = g.date
+	full, verbose, force, negotiated = g.full, g.verbose, g.force, g.negotiated
+	protocol, timeout = g.protocol, g.timeout
+}
+
+// sessionstream is a command run on behalf of a session
+type sessionstream struct {
+	stdin  *buffer
+	stdout *window
+	stderr *window
+}
+
+// sessionserver runs commands on behalf of a session
+type sessionserver struct {
+	conn     *frameconn
+	client   string
+	defaults globals
+	mu       sync.Mutex
+	streams  map[uint32]*sessionstream
+	wg       sync.WaitGroup
+}
+
+func (s *sessionserver) run(id uint32, args []string, t *sessionstream) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.streams, id)
+		s.mu.Unlock()
+		t.stdout.close()
+		t.stderr.close()
+	}()
+
+	stdout := &streamwriter{conn: s.conn, kind: frameStdout, id: id, window: t.stdout}
+	stderr := &streamwriter{conn: s.conn, kind: frameStderr, id: id, window: t.stderr}
+
+	var status int
+	var err error
+	if command := sessioncommand(args[0]); command != nil && reserve() {
+		status, err = call(command, s.defaults, args, t.stdin, stdout, stderr)
+		release()
+	} else { // another command is running: use a separate process
+		status, err = spawn(args, t.stdin, stdout, stderr)
+	}
+	if err != nil {
+		log.Println(args, err)
+		stderr.Write([]byte(JSON(ErrorFrame{Error: err.Error(), Command: args[0]})))
+		status = 1
+	}
+	t.stdin.Close()
+	s.conn.WriteFrame(frameExit, id, []byte(strconv.Itoa(status)))
+}
+
+// selfcompressed checks whether a command requests its own stream compression
+func selfcompressed(args []string) bool {
+	for _, arg := range args[1:] {
+		if arg == "--" {
+			break
+		}
+		if match, _ := isflag(arg, "compress"); match {
+			return true
+		}
+	}
+	return false
+}
+
+// running is set while a command runs in-process
+var running struct {
+	sync.Mutex
+	busy bool
+}
+
+// reserve claims this process for a command (commands share global state)
+func reserve() bool {
+	running.Lock()
+	defer running.Unlock()
+	if running.busy {
+		return false
+	}
+	running.busy = true
+	return true
+}
+
+func release() {
+	running.Lock()
+	defer running.Unlock()
+	running.busy = false
+}
+
+// call runs a command within this process, starting from the given global state
+func call(command func(), defaults globals, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	var copied sync.WaitGroup
+	in, err := pipein(stdin)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := pipeout(stdout, &copied)
+	if err != nil {
+		return 0, err
+	}
+	errout, err := pipeout(stderr, &copied)
+	if err != nil {
+		out.Close()
+		copied.Wait()
+		return 0, err
+	}
+
+	saved := saveglobals()
+	defaults.restore()
+	os.Args = args
+	cmdin, cmdout, cmderr = in, out, errout
+	compression = "" // the streams of in-process commands are never compressed
+	flag.CommandLine = flag.NewFlagSet(args[0], flag.PanicOnError)
+	globalflags()
+	failure = log.New(cmderr, failPrefix, 0)
+	exit = func(code int) { panic(exitcode(code)) }
+
+	status := invoke(command)
+	saved.restore()
+
+	out.Close()
+	errout.Close()
+	copied.Wait()
+	return status, nil
+}
+
+// invoke calls a command and returns its exit status
+func invoke(command func()) (status int) {
+	defer func() {
+		if r := recover(); r != nil {
+			if code, ok := r.(exitcode); ok {
+				status = int(code)
+			} else {
+				log.Printf("Command failed: msg=%q error=fatal\n", fmt.Sprint(r))
+				status = 2
+			}
+		}
+	}()
+	command()
+	return 0
+}
+
+// spawn runs a command as a separate process
+func spawn(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	cmd := exec.Command(programFile, args...)
+	cmd.Stdin = stdin
+	outr, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	errr, err := cmd.StderrPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	var copied sync.WaitGroup
+	copied.Add(2)
+	go forward(stdout, outr, &copied)
+	go forward(stderr, errr, &copied)
+	copied.Wait()
+
+	err = cmd.Wait()
+	if status := exitstatus(err); status >= 0 {
+		return status, nil
+	}
+	return 0, err
+}
+
+// pipein returns a file from which the data of r can be read
+func pipein(r io.Reader) (*os.File, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		io.Copy(pw, r)
+		pw.Close()
+	}()
+	return pr, nil
+}
+
+// pipeout returns a file whose data is forwarded to w
+func pipeout(w io.Writer, copied *sync.WaitGroup) (*os.File, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	copied.Add(1)
+	go func() {
+		forward(w, pr, copied)
+		pr.Close()
+	}()
+	return pw, nil
+}
+
+// forward copies the output of a command (and discards it once it can't be sent anymore)
+func forward(w io.Writer, r io.Reader, copied *sync.WaitGroup) {
+	defer copied.Done()
+	if _, err := io.Copy(w, r); err != nil {
+		io.Copy(ioutil.Discard, r)
+	}
+}
+
+// refuse reports that a session command could not be run
+func (s *sessionserver) refuse(id uint32, command string, err error) {
+	log.Printf("Denied command: client=%q command=%q msg=%q error=warn\n", s.client, command, err)
+	s.conn.WriteFrame(frameStderr, id, []byte(JSON(ErrorFrame{Error: err.Error(), Command: command})))
+	s.conn.WriteFrame(frameExit, id, []byte("1"))
+}
+
+// session runs commands on behalf of a client over a single connection (within this process,
+// against a single opened repository)
+func session() {
+	defaults := saveglobals()
+
+	flag.StringVar(&name, "name", "", "Backup name")
+	flag.StringVar(&name, "n", "", "-name")
+
+	SetupServer()
+	cfg.ServerOnly()
+
+	if err := opencatalog(); err != nil {
+		LogExit(err)
+	}
+	insession = true
+
+	s := &sessionserver{
+		conn:     &frameconn{r: bufio.NewReader(os.Stdin), w: os.Stdout},
+		client:   name,
+		defaults: defaults,
+		streams:  make(map[uint32]*sessionstream),
+	}
+
+	log.Printf("Session started: client=%q\n", s.client)
+	for {
+		kind, id, payload, err := s.conn.ReadFrame()
+		if err != nil {
+			if err != io.EOF {
+				log.Println(err)
+			}
+			break
+		}
+
+		switch kind {
+		case frameRequest:
+			var args []string
+			if err := json.Unmarshal(payload, &args); err != nil || len(args) == 0 {
+				s.refuse(id, "", errors.New("Invalid request"))
+				continue
+			}
+			if _, ok := allowed[args[0]]; !ok || args[0] == "session" {
+				s.refuse(id, args[0], errors.New("Command "+strconv.Quote(args[0])+" not allowed"))
+				continue
+			}
+			if selfcompressed(args) { // the session itself is compressed
+				s.refuse(id, args[0], errors.New("Compression not allowed within a session"))
+				continue
+			}
+			if s.client != "" {
+				command := args[0]
+				if args, err = restrict(s.client, args); err != nil {
+					s.refuse(id, command, err)
+					continue
+				}
+			}
+			debug.Println("Session command", args)
+
+			stream := &sessionstream{
+				stdin:  newbuffer(func(n int) { s.conn.Grant(frameStdin, id, n) }),
+				stdout: newwindow(),
+				stderr: newwindow(),
+			}
+			s.mu.Lock()
+			s.streams[id] = stream
+			s.mu.Unlock()
+			s.wg.Add(1)
+			go s.run(id, args, stream)
+		case frameStdin:
+			s.mu.Lock()
+			stream := s.streams[id]
+			s.mu.Unlock()
+			if stream != nil {
+				if len(payload) == 0 {
+					stream.stdin.Close()
+				} else if _, err := stream.stdin.Write(payload); err != nil {
+					stream.stdin.CloseWithError(err)
+				}
+			}
+		case frameWindow:
+			s.mu.Lock()
+			stream := s.streams[id]
+			s.mu.Unlock()
+			if kind, n, ok := parsewindow(payload); ok && stream != nil {
+				switch kind {
+				case frameStdout:
+					stream.stdout.grant(n)
+				case frameStderr:
+					stream.stderr.grant(n)
+				}
+			}
+		}
+	}
+
+	// the client went away: let running commands finish
+	s.mu.Lock()
+	for _, stream := range s.streams {
+		stream.stdin.Close()
+		stream.stdout.close()
+		stream.stderr.close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	log.Printf("Session ended: client=%q\n", s.client)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSH connection error codes (reported in error frames)
+const (
+	sshConnectError = 1 + iota
+	sshHostKeyError
+	sshAuthError
+	sshSessionError
+)
+
+// SSHError is a connection error reported by the built-in SSH client
+type SSHError struct {
+	Op   string
+	Host string
+	Code int
+	Err  error
+}
+
+func (e *SSHError) Error() string {
+	return e.Op + " " + e.Host + ": " + e.Err.Error()
+}
+
+func sshaddress() string {
+	port := 22
+	if cfg.Port > 0 {
+		port = cfg.Port
+	}
+	return net.JoinHostPort(cfg.Server, strconv.Itoa(port))
+}
+
+func sshuser() string {
+	if cfg.User != "" {
+		return cfg.User
+	}
+	return Username(os.Getuid())
+}
+
+// trusthostkey records the host key of a new server in pukcab's known-hosts file
+func trusthostkey(hostname string, key gossh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(cfg.KnownHosts), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(cfg.KnownHosts, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	log.Printf("Trusting new host key: server=%q fingerprint=%q\n", hostname, gossh.FingerprintSHA256(key))
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	return err
+}
+
+// hostkeycallback checks the server's host key against the pinned fingerprint (if any) or the known-hosts file (trusting new hosts on first use)
+func hostkeycallback(hostname string, remote net.Addr, key gossh.PublicKey) error {
+	if cfg.HostKey != "" {
+		if fingerprint := gossh.FingerprintSHA256(key); fingerprint != cfg.HostKey {
+			return &SSHError{Op: "hostkey", Host: hostname, Code: sshHostKeyError, Err: fmt.Errorf("host key mismatch (expected %s, got %s)", cfg.HostKey, fingerprint)}
+		}
+		return nil
+	}
+
+	check, err := knownhosts.New(cfg.KnownHosts)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return trusthostkey(hostname, key)
+		}
+		return &SSHError{Op: "hostkey", Host: hostname, Code: sshHostKeyError, Err: err}
+	}
+	if err = check(hostname, remote, key); err != nil {
+		if keyerr, ok := err.(*knownhosts.KeyError); ok && len(keyerr.Want) == 0 {
+			return trusthostkey(hostname, key)
+		}
+		return &SSHError{Op: "hostkey", Host: hostname, Code: sshHostKeyError, Err: err}
+	}
+	return nil
+}
+
+func sshauth() (methods []gossh.AuthMethod) {
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			methods = append(methods, gossh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		} else {
+			debug.Println("SSH agent:", err)
+		}
+	}
+
+	identities := cfg.Identity
+	if len(identities) == 0 {
+		for _, id := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			identities = append(identities, filepath.Join(os.Getenv("HOME"), ".ssh", id))
+		}
+	}
+	var signers []gossh.Signer
+	for _, id := range identities {
+		if key, err := ioutil.ReadFile(id); err == nil {
+			if signer, err := gossh.ParsePrivateKey(key); err == nil {
+				signers = append(signers, signer)
+			} else {
+				debug.Println("Ignoring SSH identity", id, err)
+			}
+		}
+	}
+	if len(signers) > 0 {
+		methods = append(methods, gossh.PublicKeys(signers...))
+	}
+
+	return
+}
+
+func sshconfig() *gossh.ClientConfig {
+	return &gossh.ClientConfig{
+		User:            sshuser(),
+		Auth:            sshauth(),
+		HostKeyCallback: hostkeycallback,
+		Timeout:         defaultConnectTimeout * time.Second,
+	}
+}
+
+// sshdial connects to the server
+func sshdial() (*gossh.Client, error) {
+	conn, err := net.DialTimeout("tcp", sshaddress(), defaultConnectTimeout*time.Second)
+	if err != nil {
+		return nil, &SSHError{Op: "connect", Host: sshaddress(), Code: sshConnectError, Err: err}
+	}
+
+	verified := false
+	config := sshconfig()
+	config.HostKeyCallback = func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		if err := hostkeycallback(hostname, remote, key); err != nil {
+			return err
+		}
+		verified = true
+		return nil
+	}
+	c, chans, reqs, err := gossh.NewClientConn(conn, sshaddress(), config)
+	if err != nil {
+		conn.Close()
+		var sshErr *SSHError
+		var netErr net.Error
+		switch {
+		case errors.As(err, &sshErr):
+			return nil, sshErr
+		case errors.As(err, &netErr):
+			return nil, &SSHError{Op: "connect", Host: sshaddress(), Code: sshConnectError, Err: err}
+		case verified: // the server is trusted: only authentication is left
+			return nil, &SSHError{Op: "authenticate", Host: sshaddress(), Code: sshAuthError, Err: err}
+		}
+		return nil, &SSHError{Op: "connect", Host: sshaddress(), Code: sshConnectError, Err: err}
+	}
+	client := gossh.NewClient(c, chans, reqs)
+
+	if cfg.Keepalive > 0 {
+		closed := make(chan struct{})
+		go func() {
+			client.Wait()
+			close(closed)
+		}()
+		go func() {
+			ticker := time.NewTicker(time.Duration(cfg.Keepalive) * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-closed:
+					return
+				case <-ticker.C:
+					if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+						log.Printf("Connection lost: server=%q msg=%q error=fatal\n", cfg.Server, err)
+						client.Close()
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	return client, nil
+}
+
+// pinhostkey makes sure the server's host key is known (without logging in)
+func pinhostkey() error {
+	conn, err := net.DialTimeout("tcp", sshaddress(), defaultConnectTimeout*time.Second)
+	if err != nil {
+		return &SSHError{Op: "connect", Host: sshaddress(), Code: sshConnectError, Err: err}
+	}
+	defer conn.Close()
+
+	verified := false
+	config := sshconfig()
+	config.Auth = nil
+	config.HostKeyCallback = func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		if err := hostkeycallback(hostname, remote, key); err != nil {
+			return err
+		}
+		verified = true
+		return nil
+	}
+
+	if _, _, _, err := gossh.NewClientConn(conn, sshaddress(), config); err != nil && !verified {
+		return err
+	}
+	return nil
+}
+
+func shellquote(arg string) string {
+	if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=.,:/+@") == "" {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// SSHCommand is a server command run through the built-in SSH client
+type SSHCommand struct {
+	command string
+	stdin   io.Reader
+	stdout  *io.PipeWriter
+	client  *gossh.Client
+	session *gossh.Session
+	done    chan struct{}
+	status  int
+	err     error
+}
+
+func newsshcommand(args []string) *SSHCommand {
+	quoted := []string{}
+	for _, arg := range args {
+		quoted = append(quoted, shellquote(arg))
+	}
+	return &SSHCommand{
+		command: strings.Join(quoted, " "),
+		done:    make(chan struct{}),
+	}
+}
+
+// sshfailure logs a connection error
+func sshfailure(err *SSHError) error {
+	log.Printf("SSH error: server=%q code=%d msg=%q error=fatal\n", cfg.Server, err.Code, err)
+	return err
+}
+
+// StdinPipe returns a pipe connected to the command's standard input
+func (s *SSHCommand) StdinPipe() (io.WriteCloser, error) {
+	r, w := io.Pipe()
+	s.stdin = r
+	return w, nil
+}
+
+// StdoutPipe returns a pipe connected to the command's standard output
+func (s *SSHCommand) StdoutPipe() (io.ReadCloser, error) {
+	r, w := io.Pipe()
+	s.stdout = w
+	return r, nil
+}
+
+// Start connects to the server and starts the command
+func (s *SSHCommand) Start(stdin io.Reader, stdout io.Writer, stderr io.Writer) (err error) {
+	if s.client, err = sshdial(); err != nil {
+		return sshfailure(err.(*SSHError))
+	}
+	if s.session, err = s.client.NewSession(); err != nil {
+		s.client.Close()
+		return sshfailure(&SSHError{Op: "session", Host: sshaddress(), Code: sshSessionError, Err: err})
+	}
+
+	if s.stdin == nil {
+		s.stdin = stdin
+	}
+	input, err := s.session.StdinPipe()
+	if err != nil {
+		s.client.Close()
+		return sshfailure(&SSHError{Op: "session", Host: sshaddress(), Code: sshSessionError, Err: err})
+	}
+	if s.stdout != nil {
+		s.session.Stdout = s.stdout
+	} else {
+		s.session.Stdout = stdout
+	}
+	s.session.Stderr = stderr
+
+	if err := s.session.Start(s.command); err != nil {
+		s.client.Close()
+		return sshfailure(&SSHError{Op: "session", Host: sshaddress(), Code: sshSessionError, Err: err})
+	}
+
+	go func() { // don't make the command wait for input it doesn't read
+		if s.stdin != nil {
+			io.Copy(input, s.stdin)
+		}
+		input.Close()
+	}()
+	go func() {
+		defer close(s.done)
+		defer s.client.Close()
+
+		err := s.session.Wait()
+		switch e := err.(type) {
+		case nil:
+		case *gossh.ExitError:
+			s.status = e.ExitStatus()
+		default:
+			s.err = sshfailure(&SSHError{Op: "session", Host: sshaddress(), Code: sshSessionError, Err: err})
+		}
+		if r, ok := s.stdin.(*io.PipeReader); ok {
+			r.Close()
+		}
+		if s.stdout != nil {
+			s.stdout.CloseWithError(s.err)
+		}
+	}()
+
+	return nil
+}
+
+// Wait waits for the command to complete
+func (s *SSHCommand) Wait() error {
+	<-s.done
+	if s.err != nil {
+		return s.err
+	}
+	if s.status != 0 {
+		return &ExitError{Code: s.status}
+	}
+	return nil
+}
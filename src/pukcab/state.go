@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"pukcab/tar"
+)
+
+// StateEntry records what a file looked like when it was last backed up
+type StateEntry struct {
+	Fingerprint string
+	Hash        string // Git-style SHA-1, as stored in the vault
+}
+
+// State is the client-side cache of the last successful backup
+type State struct {
+	Server string
+	Name   string
+	Date   BackupID
+	Files  map[string]StateEntry
+
+	updates map[string]StateEntry
+}
+
+var state *State
+
+func statefile(name string) string {
+	return filepath.Join(cfg.Cache, filepath.Base(name)+".state")
+}
+
+// NewState creates an empty state cache for a given backup name
+func NewState(name string) *State {
+	return &State{
+		Server:  cfg.Server,
+		Name:    name,
+		Files:   make(map[string]StateEntry),
+		updates: make(map[string]StateEntry),
+	}
+}
+
+// LoadState reads the state cache for a given backup name (an empty cache is returned if it cannot be read)
+func LoadState(name string) *State {
+	s := NewState(name)
+	if cfg.Cache == "" {
+		return s
+	}
+
+	if f, err := os.Open(statefile(name)); err == nil {
+		defer f.Close()
+		var cached State
+		if err := gob.NewDecoder(f).Decode(&cached); err == nil && cached.Server == cfg.Server && cached.Name == name && cached.Files != nil {
+			s.Date, s.Files = cached.Date, cached.Files
+		} else {
+			debug.Println("Ignoring state cache", statefile(name), err)
+		}
+	}
+
+	return s
+}
+
+// Valid checks whether the cache corresponds to a given backup set
+func (s *State) Valid(date BackupID) bool {
+	return s != nil && date != 0 && s.Date == date
+}
+
+// Fingerprint summarises the metadata of a file (a change of fingerprint means the file needs to be backed up again)
+func Fingerprint(hdr *tar.Header) string {
+	return fmt.Sprintf("%c %o %d:%d %d %d %d %q", hdr.Typeflag, hdr.Mode, hdr.Uid, hdr.Gid, hdr.Size, hdr.ModTime.Unix(), hdr.ChangeTime.Unix(), hdr.Linkname)
+}
+
+func stat(file string) (*tar.Header, error) {
+	fi, err := os.Lstat(file)
+	if err != nil {
+		return nil, err
+	}
+	link := ""
+	if fi.Mode()&os.ModeSymlink != 0 {
+		link, _ = os.Readlink(file)
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		hdr.Size = 0
+	}
+	return hdr, nil
+}
+
+// Unchanged checks whether a file is still identical to the cached version (and keeps it for the next backup)
+func (s *State) Unchanged(file string) bool {
+	if s == nil {
+		return false
+	}
+	entry, ok := s.Files[file]
+	if !ok {
+		return false
+	}
+	if hdr, err := stat(file); err == nil && Fingerprint(hdr) == entry.Fingerprint {
+		s.updates[file] = entry
+		return true
+	}
+	return false
+}
+
+// Lookup returns the cached hash of a file, if its fingerprint didn't change
+func (s *State) Lookup(file string, hdr *tar.Header) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	if entry, ok := s.Files[file]; ok && entry.Hash != "" && entry.Fingerprint == Fingerprint(hdr) {
+		return entry.Hash, true
+	}
+	return "", false
+}
+
+// Record stores the current state of a file for the next backup
+func (s *State) Record(file string, hdr *tar.Header, hash string) {
+	if s == nil || hdr == nil {
+		return
+	}
+	s.updates[file] = StateEntry{
+		Fingerprint: Fingerprint(hdr),
+		Hash:        hash,
+	}
+}
+
+// Keep records the current state of a file that was found unchanged on the server
+func (s *State) Keep(file string, hash string) {
+	if s == nil {
+		return
+	}
+	if hdr, err := stat(file); err == nil {
+		s.Record(file, hdr, hash)
+	}
+}
+
+// Commit makes recorded entries the reference for a given backup set and saves the cache
+func (s *State) Commit(date BackupID) error {
+	if s == nil || cfg.Cache == "" {
+		return nil
+	}
+
+	s.Date, s.Files = date, s.updates
+	s.updates = make(map[string]StateEntry)
+
+	if err := os.MkdirAll(cfg.Cache, 0700); err != nil {
+		return err
+	}
+	tmp := statefile(s.Name) + "~"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(s); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, statefile(s.Name))
+}
+
+// Invalidate removes the state cache for a given backup name
+func (s *State) Invalidate() {
+	if s == nil || cfg.Cache == "" {
+		return
+	}
+	if err := os.Remove(statefile(s.Name)); err != nil && !os.IsNotExist(err) {
+		log.Println("Could not remove state cache:", err)
+	}
+	s.Date = 0
+	s.Files = make(map[string]StateEntry)
+}
+
+// GitHash computes a Git-style hash (SHA-1 with "blob<size>\0" prefix) while data is being written
+func GitHash(size int64) hash.Hash {
+	h := sha1.New()
+	io.WriteString(h, "blob "+strconv.FormatInt(size, 10)+"\000")
+	return h
+}
+
+// HashString returns the textual representation of a Git-style hash
+func HashString(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
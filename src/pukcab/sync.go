@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"pukcab/tar"
+)
+
+// finished checks whether a backup is complete (as reported locally or by a remote server)
+func finished(b Backup) bool {
+	return !b.Finished.IsZero() && b.Finished.Unix() != 0
+}
+
+// remotebackups lists the backups on the remote server
+func remotebackups(name string, schedule string) (list []Backup, err error) {
+	filter := &Backup{Name: name, Schedule: schedule}
+	err = process("metadata", filter, func(hdr tar.Header) {
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			list = append(list, Backup{
+				Date:     BackupID(hdr.ModTime.Unix()),
+				Name:     hdr.Name,
+				Schedule: hdr.Linkname,
+				Finished: hdr.ChangeTime,
+				Pinned:   hdr.Xattrs["backup.pinned"] != "",
+			})
+		}
+	})
+	return
+}
+
+// gitremote returns the URL of the remote vault
+func gitremote(vault string) string {
+	host := cfg.Server
+	if cfg.User != "" {
+		host = cfg.User + "@" + host
+	}
+	if cfg.Port > 0 {
+		host += ":" + strconv.Itoa(cfg.Port)
+	}
+	if !filepath.IsAbs(vault) {
+		vault = "/~/" + vault
+	}
+	return "ssh://" + host + vault
+}
+
+func rungit(args ...string) error {
+	if !verbose {
+		args = append([]string{args[0], "--quiet"}, args[1:]...)
+	}
+	cmd := exec.Command("git", append([]string{"--git-dir", filepath.Join(cfg.Vault, ".git")}, args...)...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	debug.Println("Running git", strings.Join(args, " "))
+	return cmd.Run()
+}
+
+// syncvault copies finished backups (their tag, the branch of their client and all the objects
+// they need) between the local vault and the vault of another server, using git over SSH
+func syncvault() {
+	pull := false
+	prune := false
+	user := ""
+	port := 0
+	vault := defaultVault
+	flag.StringVar(&name, "name", "", "Backup name")
+	flag.StringVar(&name, "n", "", "-name")
+	flag.StringVar(&schedule, "schedule", "", "Backup schedule")
+	flag.StringVar(&schedule, "r", "", "-schedule")
+	flag.BoolVar(&pull, "pull", pull, "Copy backups from the remote server")
+	flag.BoolVar(&prune, "prune", prune, "Delete backups which no longer exist on the source")
+	flag.StringVar(&user, "user", user, "User on the remote server")
+	flag.StringVar(&user, "u", user, "-user")
+	flag.IntVar(&port, "port", port, "SSH port of the remote server")
+	flag.StringVar(&vault, "vault", vault, "Vault on the remote server")
+
+	SetupServer()
+	cfg.ServerOnly()
+
+	if len(flag.Args()) != 1 {
+		failure.Fatal("Usage: ", programName, " sync [options] [user@]server")
+	}
+
+	if err := opencatalog(); err != nil {
+		LogExit(err)
+	}
+	local := Backups(repository, name, schedule)
+
+	// run the following commands on the remote server
+	cfg.Server, cfg.User, cfg.Port = flag.Args()[0], user, port
+	if i := strings.LastIndex(cfg.Server, "@"); i >= 0 {
+		cfg.User, cfg.Server = cfg.Server[:i], cfg.Server[i+1:]
+	}
+	remote, err := remotebackups(name, schedule)
+	if err != nil {
+		LogExit(err)
+	}
+
+	source, destination := local, remote
+	direction := "push"
+	if pull {
+		source, destination = remote, local
+		direction = "fetch"
+	}
+
+	done := make(map[BackupID]bool)
+	for _, b := range destination {
+		done[b.Date] = finished(b)
+	}
+
+	branches := make(map[string]struct{})
+	refspecs := []string{}
+	existing := make(map[BackupID]struct{})
+	for _, b := range source {
+		existing[b.Date] = struct{}{}
+		if finished(b) && !done[b.Date] {
+			branches[b.Name] = struct{}{}
+			refspecs = append(refspecs, "+refs/tags/"+b.Date.String()+":refs/tags/"+b.Date.String())
+		}
+	}
+	names := []string{}
+	for n := range branches {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		refspecs = append(refspecs, "+refs/heads/"+n+":refs/heads/"+n)
+	}
+
+	url := gitremote(vault)
+	log.Printf("Synchronising vault: remote=%q direction=%s backups=%d\n", url, direction, len(refspecs)-len(names))
+	if len(refspecs) > 0 {
+		args := []string{direction, "--no-tags"}
+		if pull {
+			args = append(args, "--update-head-ok")
+		}
+		if err := rungit(append(append(args, url), refspecs...)...); err != nil {
+			failure.Println("Synchronisation failed:", err)
+			log.Fatalf("Synchronising vault: remote=%q msg=%q error=fatal\n", url, err)
+		}
+		for _, b := range source {
+			if finished(b) && !done[b.Date] {
+				info.Printf("Copied backup: date=%d name=%q schedule=%q\n", b.Date, b.Name, b.Schedule)
+			}
+		}
+	}
+
+	if prune {
+		deleted := []string{}
+		for _, b := range destination {
+			if _, ok := existing[b.Date]; !ok && finished(b) && !b.Pinned {
+				deleted = append(deleted, b.Date.String())
+				if !pull {
+					continue
+				}
+				if err := repository.UnTag(b.Date.String()); err != nil {
+					log.Printf("Deleting backup: date=%d name=%q error=warn msg=%q\n", b.Date, b.Name, err)
+					continue
+				}
+				log.Printf("Deleted backup: date=%d name=%q\n", b.Date, b.Name)
+			}
+		}
+		if !pull && len(deleted) > 0 {
+			refspecs := []string{}
+			for _, d := range deleted {
+				refspecs = append(refspecs, ":refs/tags/"+d)
+			}
+			if err := rungit(append([]string{"push", url}, refspecs...)...); err != nil {
+				failure.Println("Could not delete remote backups:", err)
+				log.Printf("Deleting remote backups: remote=%q msg=%q error=warn\n", url, err)
+			}
+		}
+		for _, d := range deleted {
+			info.Println("Deleted backup:", d)
+		}
+	}
+
+	fmt.Printf("%d backup(s) copied\n", len(refspecs)-len(names))
+}
@@ -169,7 +169,7 @@ tr.total td.total {
     color: #f00;
 }
 
-#progress {
+.progress {
  width: 100px;   
  border: 1px solid #ccc;
  position: relative;
@@ -182,7 +182,7 @@ tr.total td.total {
  font-size: .2em;
 }
 
-#bar {
+.bar {
  height: 10px;
  background-color: #ccc;
  width: 50%;
@@ -216,6 +216,7 @@ const webparts = `{{define "MAINMENU"}}<div class="mainmenu">
 <a href="{{root}}/">Home</a>
 <a href="{{root}}/dashboard">Dashboard</a>
 <a href="{{root}}/backups">Backups</a>
+{{if isserver}}<a href="{{root}}/jobs">Jobs</a>{{end}}
 {{if isserver}}<a href="{{root}}/tools">Tools</a>{{end}}
 </div>{{end}}
 {{define "BROWSEMENU"}}
@@ -268,12 +269,30 @@ const webparts = `{{define "MAINMENU"}}<div class="mainmenu">
 {{if .Vault}}<tr><th class="rowtitle">Vault</th><td><tt>{{.Vault}}</tt></td></tr>{{end}}
 {{if .Catalog}}<tr><th class="rowtitle">Catalog</th><td><tt>{{.Catalog}}</tt></td></tr>{{end}}
 {{if .Maxtries}}<tr><th class="rowtitle">Maxtries</th><td>{{.Maxtries}}</td></tr>{{end}}
+{{if .Interval}}<tr><th class="rowtitle">Interval</th><td>{{.Interval}}</td></tr>{{end}}
 <tr><th class="rowtitle">Expiration</th><td>
 {{if .Expiration.Daily}}<tt>daily={{.Expiration.Daily}}</tt>{{end}}
 {{if .Expiration.Weekly}}<tt>weekly={{.Expiration.Weekly}}</tt>{{end}}
 {{if .Expiration.Monthly}}<tt>monthly={{.Expiration.Monthly}}</tt>{{end}}
 {{if .Expiration.Yearly}}<tt>yearly={{.Expiration.Yearly}}</tt>{{end}}
+{{if .Expiration.Failed}}<tt>failed={{.Expiration.Failed}}</tt>{{end}}
 </td></tr>
+{{if .Retention.Enabled}}<tr><th class="rowtitle">Retention</th><td>
+{{if .Retention.Daily}}<tt>daily={{.Retention.Daily}}</tt>{{end}}
+{{if .Retention.Weekly}}<tt>weekly={{.Retention.Weekly}}</tt>{{end}}
+{{if .Retention.Monthly}}<tt>monthly={{.Retention.Monthly}}</tt>{{end}}
+{{if .Retention.Yearly}}<tt>yearly={{.Retention.Yearly}}</tt>{{end}}
+</td></tr>{{end}}
+{{if .Clients}}<tr><th class="rowtitle">Clients</th><td>
+{{range $pattern, $client := .Clients}}
+<tt>{{$pattern}}</tt>
+{{end}}
+</td></tr>{{end}}
+{{if .Schedule}}<tr><th class="rowtitle">Schedules</th><td>
+{{range .Schedule}}
+<tt>{{.Name}}={{.Interval}}/{{.Expiration}}d</tt>
+{{end}}
+</td></tr>{{end}}
 {{end}}
 {{if .User}}<tr><th class="rowtitle">User</th><td>{{.User}}</td></tr>{{end}}
 <tr><th class="rowtitle">Include</th><td>
@@ -286,6 +305,11 @@ const webparts = `{{define "MAINMENU"}}<div class="mainmenu">
 <tt>{{.}}</tt>
 {{end}}
 </td></tr>
+{{if .Profile}}<tr><th class="rowtitle">Profiles</th><td>
+{{range $p, $profile := .Profile}}
+<tt>{{$p}}</tt>
+{{end}}
+</td></tr>{{end}}
 </tbody></table>
 {{template "FOOTER" .}}{{end}}
 
@@ -303,7 +327,7 @@ const webparts = `{{define "MAINMENU"}}<div class="mainmenu">
 <tbody>
     {{range .}}
         <td><a href="../backups/{{.Name}}">{{.Name}}</a>{{if eq .Name $me}} &#9734;{{end}}</td>
-        <td title="{{.Size | bytes}}">{{.Count}}</td>
+        <td title="{{.Size | bytes}}">{{.Count}}{{if .Pinned}} <span title="{{.Pinned}} pinned">&#128204;</span>{{end}}</td>
         <td title="{{.First | date}}"><a href="{{root}}/backups/{{.Name}}/{{.First.Unix}}">{{.First | dateshort}}</a></td>
         {{$last := .Last}}
         {{$name := .Name}}
@@ -330,7 +354,7 @@ const webparts = `{{define "MAINMENU"}}<div class="mainmenu">
 <tbody>
     {{range .}}
 	<tr class="{{. | status}} {{.Schedule}}">
-        <td title="{{.Date | date}}"><a href="{{root}}/backups/{{.Name}}/{{.Date}}">{{.Date}}</a></td>
+        <td title="{{.Date | date}}"><a href="{{root}}/backups/{{.Name}}/{{.Date}}">{{.Date}}</a>{{if .Label}} <tt title="{{.Comment}}">{{.Label}}</tt>{{end}}{{if .Pinned}} <span title="pinned">&#128204;</span>{{end}}</td>
         <td title="{{. | status}}"><a href="{{.Name}}">{{.Name}}</a>{{if eq .Name $me}} &#9734;{{end}}</td>
         <td>{{.Schedule}}</td>
         <td {{if (.Finished | date)}} title="{{(.Finished.Sub .Date.Time)}}"{{end}}>{{.Finished | date}}</td>
@@ -354,12 +378,15 @@ const webparts = `{{define "MAINMENU"}}<div class="mainmenu">
 {{with .Backups}}
 {{$me := hostname}}
     {{range .}}
-<div class="submenu">{{if .Files}}<a href="{{root}}/dav/{{.Name}}/{{.Date}}">Open</a><a href="" {{if ne $me .Name}}onclick="return confirm('This backup seems to be from a different system ({{.Name}}).\n\nAre you sure you want to verify it on {{$me}}?')"{{end}}>&#10003; Verify</a>{{end}}<a href="{{root}}/delete/{{.Name}}/{{.Date}}" onclick="return confirm('Are you sure?')" class="caution">&#10006; Delete</a></div>
+<div class="submenu">{{if .Files}}<a href="{{root}}/dav/{{.Name}}/{{.Date}}">Open</a><a href="" {{if ne $me .Name}}onclick="return confirm('This backup seems to be from a different system ({{.Name}}).\n\nAre you sure you want to verify it on {{$me}}?')"{{end}}>&#10003; Verify</a>{{end}}{{if .Files}}<a href="{{root}}/analysis/{{.Name}}/{{.Date}}">Analysis</a><a href="{{root}}/diff/?name={{.Name}}&amp;to={{.Date}}">Changes</a>{{end}}{{if not .Pinned}}<a href="{{root}}/delete/{{.Name}}/{{.Date}}" onclick="return confirm('Are you sure?')" class="caution">&#10006; Delete</a>{{end}}</div>
 <table class="report">
 <tbody>
 	<tr><th class="rowtitle">ID</th><td class="{{. | status}}" title="{{. | status}}">{{.Date}}</td></tr>
         <tr><th class="rowtitle">Name</th><td>{{.Name}}</td></tr>
         <tr class="{{.Schedule}}"><th class="rowtitle">Schedule</th><td>{{.Schedule}}</td></tr>
+        {{if .Label}}<tr><th class="rowtitle">Label</th><td>{{.Label}}</td></tr>{{end}}
+        {{if .Comment}}<tr><th class="rowtitle">Comment</th><td>{{.Comment}}</td></tr>{{end}}
+        {{if .Pinned}}<tr><th class="rowtitle">Pinned</th><td>&#128204; yes</td></tr>{{end}}
         <tr><th class="rowtitle">Started</th><td>{{.Date | date}}</td></tr>
         {{if .Files}}<tr><th class="rowtitle">Finished</th><td title="{{.Finished}}">{{.Finished | date}}</td></tr>{{end}}
         {{if .Size}}<tr><th class="rowtitle">Size</th><td>{{.Size | bytes}}</td></tr>{{end}}
@@ -403,18 +430,133 @@ const webparts = `{{define "MAINMENU"}}<div class="mainmenu">
 <table class="report"><tbody>
 {{if .VaultCapacity}}<tr><th class="rowtitle">Storage{{if .CatalogCapacity}} (vault){{end}}</th><td>{{.VaultCapacity | bytes}}</td></tr>{{end}}
 {{if .VaultFS}}<tr><th class="rowtitle">Filesystem</th><td>{{.VaultFS}}</td></tr>{{end}}
-{{if .VaultBytes}}<tr><th class="rowtitle">Used</th><td><div id="progress" title="{{printf "%.1f" .VaultUsed}}%"><div id="bar" style="width:{{printf "%.1f" .VaultUsed}}%"></div></div></td></tr>{{end}}
+{{if .VaultBytes}}<tr><th class="rowtitle">Used</th><td><div class="progress" title="{{printf "%.1f" .VaultUsed}}%"><div class="bar" style="width:{{printf "%.1f" .VaultUsed}}%"></div></div></td></tr>{{end}}
 {{if .VaultFree}}<tr><th class="rowtitle">Free</th><td>{{.VaultFree | bytes}}</td></tr>{{end}}
 {{if .CatalogCapacity}}
 <tr><th class="rowtitle">Storage (catalog)</th><td>{{.CatalogCapacity | bytes}}</td></tr>
 {{if .CatalogFS}}<tr><th class="rowtitle">Filesystem</th><td>{{.CatalogFS}}</td></tr>{{end}}
-{{if .CatalogBytes}}<tr><th class="rowtitle">Used</th><td><div id="progress"><div id="bar" style="width:{{printf "%.1f" .CatalogUsed}}%"></div></div></td></tr>{{end}}
+{{if .CatalogBytes}}<tr><th class="rowtitle">Used</th><td><div class="progress"><div class="bar" style="width:{{printf "%.1f" .CatalogUsed}}%"></div></div></td></tr>{{end}}
 {{if .CatalogFree}}<tr><th class="rowtitle">Free</th><td>{{.CatalogFree | bytes}}</td></tr>{{end}}
 {{end}}
 </td></tr>
 </tbody></table>
 {{template "FOOTER" .}}{{end}}
 
+{{define "ANALYSIS"}}{{template "HEADER" .}}
+{{$unique := .Unique}}
+<div class="submenu">
+<a class="label" href="{{root}}/backups/{{.Name}}/{{.Date}}">&#x2191; Backup</a>
+{{if ne .Path "/"}}<a class="label" href="?path={{dirname .Path}}{{if $unique}}&amp;unique=1{{end}}">&#x2191; Up</a>{{end}}
+{{if $unique}}<a class="label" href="?path={{.Path}}">All data</a>{{else}}<a class="label" href="?path={{.Path}}&amp;unique=1">Unique data</a>{{end}}
+</div>
+<table class="report">
+<thead><tr><th>{{.Path}}</th><th>{{.Size | bytes}}</th><th></th></tr></thead>
+<tbody>
+    {{range .Entries}}
+	<tr>
+        <td>{{if .Dir}}<a href="?path={{.Path}}{{if $unique}}&amp;unique=1{{end}}">{{basename .Path}}/</a>{{else}}{{basename .Path}}{{end}}</td>
+        <td>{{.Size | bytes}}</td>
+        <td><div class="progress" title="{{printf "%.1f" .Percent}}%"><div class="bar" style="width:{{printf "%.1f" .Percent}}%"></div></div></td>
+	</tr>
+    {{end}}
+</tbody>
+</table>
+    {{if not .Entries}}<div class="placeholder">empty list</div>{{end}}
+{{template "FOOTER" .}}{{end}}
+
+{{define "DIFF"}}{{template "HEADER" .}}
+<div class="submenu">
+<a class="label" href="{{root}}/backups/{{.FromName}}/{{.From}}">{{.FromName}} {{.From}}</a>
+<a class="label" href="{{root}}/backups/{{.ToName}}/{{.To}}">{{.ToName}} {{.To}}</a>
+</div>
+<table class="report">
+<tbody>
+	<tr><th class="rowtitle">From</th><td>{{.FromName}} ({{.From | date}})</td></tr>
+	<tr><th class="rowtitle">To</th><td>{{.ToName}} ({{.To | date}})</td></tr>
+	<tr><th class="rowtitle">Added</th><td>{{.Added}}</td></tr>
+	<tr><th class="rowtitle">Removed</th><td>{{.Removed}}</td></tr>
+	<tr><th class="rowtitle">Modified</th><td>{{.Modified}}</td></tr>
+	<tr><th class="rowtitle">Metadata</th><td>{{.Metadata}}</td></tr>
+</tbody>
+</table>
+{{with .Differences}}
+<table class="report">
+<thead><tr><th>Path</th><th>Change</th><th>Size</th></tr></thead>
+<tbody>
+    {{range .}}
+	<tr>
+        <td>{{.Path}}</td>
+        <td>{{.Change}}{{with .Fields}} ({{range $i, $f := .}}{{if $i}}, {{end}}{{$f}}{{end}}){{end}}</td>
+        <td>{{if .Size}}{{.Size | bytes}}{{end}}</td>
+	</tr>
+    {{end}}
+</tbody>
+</table>
+{{else}}
+<div class="placeholder">no differences</div>
+{{end}}
+{{template "FOOTER" .}}{{end}}
+
+{{define "JOBS"}}{{template "HEADER" .}}
+<div class="submenu">
+<a class="label" href="{{root}}/jobs/">&#x21bb; Refresh</a>
+</div>
+<form method="post" action="{{root}}/jobs/">
+<table class="report"><tbody>
+<tr><th class="rowtitle">Name</th><td><input type="text" name="name" required></td></tr>
+<tr><th class="rowtitle">Command</th><td><select name="command">
+<option value="backup">backup</option>
+<option value="resume">resume</option>
+<option value="verify">verify</option>
+<option value="restore">restore</option>
+</select></td></tr>
+<tr><th class="rowtitle">Date</th><td><input type="text" name="date" placeholder="latest"></td></tr>
+<tr><th class="rowtitle">Directory</th><td><input type="text" name="directory" placeholder="restore only"></td></tr>
+<tr><th class="rowtitle">Files</th><td><input type="text" name="files"></td></tr>
+<tr><th class="rowtitle"></th><td><input type="submit" value="Queue"></td></tr>
+</tbody></table>
+</form>
+{{$count := len .Jobs}}
+{{with .Jobs}}
+<table class="report">
+<thead><tr><th>ID</th><th>Name</th><th>Command</th><th>State</th><th>Queued</th><th>Finished</th><th></th></tr></thead>
+<tbody>
+    {{range .}}
+	<tr class="{{.State}}">
+        <td><a href="{{root}}/jobs/{{.ID}}">{{.ID}}</a></td>
+        <td>{{.Name}}</td>
+        <td>{{.Command}} {{range .Args}}<tt>{{.}}</tt> {{end}}</td>
+        <td{{if eq .State "done" "failed"}} title="exit status {{.Status}}"{{end}}>{{.State}}</td>
+        <td>{{.Queued | date}}</td>
+        <td>{{.Finished | date}}</td>
+        <td>{{if eq .State "queued"}}<a href="{{root}}/jobs/cancel/{{.ID}}" class="caution">&#10006; Cancel</a>{{end}}</td>
+	</tr>
+    {{end}}
+</tbody>
+</table>
+{{end}}
+    {{if not $count}}<div class="placeholder">empty list</div>{{end}}
+{{template "FOOTER" .}}{{end}}
+
+{{define "JOB"}}{{template "HEADER" .}}
+<div class="submenu">
+<a class="label" href="{{root}}/jobs/">&#x2191; Jobs</a>
+</div>
+{{range .Jobs}}
+<table class="report"><tbody>
+<tr><th class="rowtitle">ID</th><td>{{.ID}}</td></tr>
+<tr><th class="rowtitle">Name</th><td>{{.Name}}</td></tr>
+<tr><th class="rowtitle">Command</th><td>{{.Command}} {{range .Args}}<tt>{{.}}</tt> {{end}}</td></tr>
+<tr class="{{.State}}"><th class="rowtitle">State</th><td>{{.State}}{{if eq .State "done" "failed"}} (exit status {{.Status}}){{end}}</td></tr>
+<tr><th class="rowtitle">Queued</th><td>{{.Queued | date}}</td></tr>
+<tr><th class="rowtitle">Started</th><td>{{.Started | date}}</td></tr>
+<tr><th class="rowtitle">Finished</th><td>{{.Finished | date}}</td></tr>
+</tbody></table>
+{{if .Output}}<pre class="ls">{{range .Output}}{{.}}
+{{end}}</pre>{{end}}
+{{end}}
+{{template "FOOTER" .}}{{end}}
+
 {{define "BUSY"}}{{template "HEADER" .}}
 <div class="submenu">
 <a class="label" href="{{root}}/">Cancel</a>
@@ -1,10 +1,8 @@
 package main
 
 import (
-	"crypto/sha1"
 	"crypto/sha512"
 	"encoding/base64"
-	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
@@ -24,11 +22,16 @@ type BackupID int64
 
 // BackupInfo describes a backup set
 type BackupInfo struct {
-	Date           BackupID
-	Finished       time.Time
-	LastModified   time.Time
-	Name, Schedule string
-	Files, Size    int64
+	Date         BackupID  `json:"date"`
+	Finished     time.Time `json:"finished"`
+	LastModified time.Time `json:"lastmodified"`
+	Name         string    `json:"name"`
+	Schedule     string    `json:"schedule,omitempty"`
+	Files        int64     `json:"files,omitempty"`
+	Size         int64     `json:"size,omitempty"`
+	Pinned       bool      `json:"pinned,omitempty"`
+	Label        string    `json:"label,omitempty"`
+	Comment      string    `json:"comment,omitempty"`
 }
 
 // String returns the backup set ID as a printable string
@@ -105,11 +108,10 @@ func Hash(filename string) (hash1 string, hash2 string) {
 
 		if fileinfo, err := file.Stat(); err == nil {
 			h1 := sha512.New()
-			h2 := sha1.New()
-			io.WriteString(h2, "blob "+strconv.FormatInt(fileinfo.Size(), 10)+"\000")
+			h2 := GitHash(fileinfo.Size())
 
 			if _, err := io.Copy(io.MultiWriter(h1, h2), file); err == nil {
-				return EncodeHash(h1.Sum(nil)), hex.EncodeToString(h2.Sum(nil))
+				return EncodeHash(h1.Sum(nil)), HashString(h2)
 			}
 		}
 	}
@@ -141,6 +143,27 @@ func Bytes(s uint64) string {
 	return human(s, 1024, sizes)
 }
 
+// ParseBytes parses a human readable byte size (e.g. "512M", "10GiB")
+func ParseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	val, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid size %q", s)
+	}
+	unit := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s[i:])), "B"), "I")
+	for _, u := range []string{"", "K", "M", "G", "T", "P", "E"} {
+		if unit == u {
+			return int64(val), nil
+		}
+		val *= 1024
+	}
+	return 0, fmt.Errorf("Invalid size %q", s)
+}
+
 func printdebug() {
 	_, fn, line, _ := runtime.Caller(1)
 	log.Printf("DEBUG %s:%d\n", fn, line)
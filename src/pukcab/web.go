@@ -1,7 +1,7 @@
 package main
 
 import (
-	"encoding/gob"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
@@ -9,7 +9,7 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
 	"runtime"
 	"sort"
@@ -71,6 +71,27 @@ type StorageReport struct {
 	VaultUsed, CatalogUsed                     float32
 }
 
+// JobsReport lists jobs queued for clients
+type JobsReport struct {
+	Report
+	Jobs []Job
+}
+
+// AnalysisReport shows the size of the files and directories of a backup set
+type AnalysisReport struct {
+	Report
+	*Analysis
+	Path    string
+	Size    int64
+	Entries []Usage
+}
+
+// DiffReport shows the differences between two backup sets
+type DiffReport struct {
+	Report
+	*Diff
+}
+
 func stylesheets(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/css; charset=UTF-8")
 	fmt.Fprint(w, css)
@@ -154,6 +175,9 @@ func webdashboard(w http.ResponseWriter, r *http.Request) {
 						client.Size = hdr.Size
 					}
 					client.Count++
+					if hdr.Xattrs["backup.pinned"] != "" {
+						client.Pinned++
+					}
 
 					clients[hdr.Name] = client
 				} else {
@@ -163,6 +187,9 @@ func webdashboard(w http.ResponseWriter, r *http.Request) {
 					client.Last[hdr.Xattrs["backup.schedule"]] = hdr.ModTime
 					client.Size = hdr.Size
 					client.Count++
+					if hdr.Xattrs["backup.pinned"] != "" {
+						client.Pinned++
+					}
 
 					clients[hdr.Name] = client
 				}
@@ -179,14 +206,13 @@ func webdashboard(w http.ResponseWriter, r *http.Request) {
 		Report: Report{
 			Title: "Dashboard",
 		},
-		Schedules: []string{"daily", "weekly", "monthly", "yearly"},
+		Schedules: cfg.ScheduleNames(),
 		Clients:   []Client{},
 	}
 
-	delete(schedules, "daily")
-	delete(schedules, "weekly")
-	delete(schedules, "monthly")
-	delete(schedules, "yearly")
+	for _, s := range report.Schedules {
+		delete(schedules, s)
+	}
 	for s := range schedules {
 		report.Schedules = append(report.Schedules, s)
 	}
@@ -282,9 +308,8 @@ func webinfo(w http.ResponseWriter, r *http.Request) {
 
 		switch hdr.Typeflag {
 		case tar.TypeXGlobalHeader:
-			var header BackupInfo
-			dec := gob.NewDecoder(tr)
-			if err := dec.Decode(&header); err != nil {
+			header, err := ReadBackupInfo(tr)
+			if err != nil {
 				http.Error(w, "Protocol error: "+err.Error(), http.StatusBadGateway)
 				log.Println(err)
 				return
@@ -308,21 +333,17 @@ func webinfo(w http.ResponseWriter, r *http.Request) {
 
 	if err := cmd.Wait(); err != nil {
 
-		if exiterr, ok := err.(*exec.ExitError); ok {
-			// The program has exited with an exit code != 0
-			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-				switch status.ExitStatus() {
-				case 2: // retry
-					w.Header().Set("Refresh", "10")
-					w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-					w.WriteHeader(http.StatusAccepted)
-					pages.ExecuteTemplate(w, "BUSY", report)
-				default:
-					log.Println(cmd.Args, err)
-					http.Error(w, "Backend error: "+err.Error(), http.StatusServiceUnavailable)
-				}
-			}
-		} else {
+		// The program has exited with an exit code != 0
+		switch status := exitstatus(err); {
+		case status == 2: // retry
+			w.Header().Set("Refresh", "10")
+			w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+			w.WriteHeader(http.StatusAccepted)
+			pages.ExecuteTemplate(w, "BUSY", report)
+		case status > 0:
+			log.Println(cmd.Args, err)
+			http.Error(w, "Backend error: "+err.Error(), http.StatusServiceUnavailable)
+		default:
 			log.Println(cmd.Args, err)
 		}
 
@@ -380,11 +401,107 @@ func webdelete(w http.ResponseWriter, r *http.Request) {
 	args := []string{"purgebackup", "-name", name, "-date", fmt.Sprintf("%d", date)}
 	cmd := remotecommand(args...)
 
-	go cmd.Run()
+	if err := cmd.Run(); err != nil { // pinned backups can't be deleted
+		log.Println(cmd.Args, err)
+		http.Error(w, "Could not delete backup: "+err.Error(), http.StatusConflict)
+		return
+	}
 
 	http.Redirect(w, r, "/backups/", http.StatusFound)
 }
 
+func webanalysis(w http.ResponseWriter, r *http.Request) {
+	date = 0
+	name = ""
+
+	req := strings.SplitN(r.URL.Path[1:], "/", 3)
+	if len(req) != 3 {
+		http.Error(w, "Invalid request", http.StatusNotAcceptable)
+		return
+	}
+	name = req[1]
+	if d, err := strconv.Atoi(req[2]); err == nil {
+		date = BackupID(d)
+	}
+	if date == 0 || name == "" {
+		http.Error(w, "Invalid request", http.StatusNotAcceptable)
+		return
+	}
+
+	a, err := analyse(name, date, r.FormValue("unique") != "")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Backend error: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if a.Date != date {
+		http.NotFound(w, r)
+		return
+	}
+
+	report := &AnalysisReport{
+		Report: Report{
+			Title: "Analysis",
+		},
+		Analysis: a,
+		Path:     path.Join("/", r.FormValue("path")),
+	}
+	report.Size = a.Dirs[report.Path]
+	report.Entries = a.Children(report.Path)
+
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	if err := pages.ExecuteTemplate(w, "ANALYSIS", report); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal error: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func webdiff(w http.ResponseWriter, r *http.Request) {
+	var from, to BackupID
+	name = r.FormValue("name")
+	if name == "" {
+		http.Error(w, "Invalid request", http.StatusNotAcceptable)
+		return
+	}
+	if d := r.FormValue("from"); d != "" {
+		if err := from.Set(d); err != nil {
+			http.Error(w, "Invalid request", http.StatusNotAcceptable)
+			return
+		}
+	}
+	to.Set("now")
+	if d := r.FormValue("to"); d != "" {
+		if err := to.Set(d); err != nil {
+			http.Error(w, "Invalid request", http.StatusNotAcceptable)
+			return
+		}
+	}
+
+	d, err := diffbackups(name, from, r.FormValue("with"), to)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Backend error: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if d.From == 0 || d.To == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	report := &DiffReport{
+		Report: Report{
+			Title: "Differences",
+		},
+		Diff: d,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	if err := pages.ExecuteTemplate(w, "DIFF", report); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal error: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func webnew(w http.ResponseWriter, r *http.Request) {
 	report := &ConfigReport{
 		Report: Report{
@@ -450,6 +567,88 @@ func webtools(w http.ResponseWriter, r *http.Request) {
 	pages.ExecuteTemplate(w, "DF", report)
 }
 
+func webjobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		args := []string{"jobs", "-name", r.FormValue("name"), "-queue", r.FormValue("command"), "--"}
+		if d := r.FormValue("date"); d != "" {
+			args = append(args, "-date", d)
+		}
+		if d := r.FormValue("directory"); d != "" {
+			args = append(args, "-directory", d)
+		}
+		args = append(args, strings.Fields(r.FormValue("files"))...)
+		if err := remotecommand(args...).Run(); err != nil {
+			log.Println(args, err)
+			http.Error(w, "Could not queue job", http.StatusNotAcceptable)
+			return
+		}
+		http.Redirect(w, r, "/jobs/", http.StatusFound)
+		return
+	}
+
+	id := ""
+	req := strings.SplitN(r.RequestURI[1:], "/", 3)
+	if len(req) > 1 {
+		id = req[1]
+	}
+	if len(req) > 2 && len(req[2]) > 0 {
+		http.Error(w, "Invalid request", http.StatusNotAcceptable)
+		return
+	}
+
+	cmd := remotecommand("jobs", "-json")
+	out, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		log.Println(cmd.Args, err)
+		http.Error(w, "Backend error: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	report := &JobsReport{
+		Report: Report{
+			Title: "Jobs",
+		},
+	}
+	decoder := json.NewDecoder(out)
+	for {
+		var job Job
+		if err := decoder.Decode(&job); err != nil {
+			break
+		}
+		if id == "" || job.ID == id {
+			report.Jobs = append([]Job{job}, report.Jobs...) // most recent first
+		}
+	}
+	cmd.Wait()
+
+	page := "JOBS"
+	if id != "" {
+		if len(report.Jobs) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		page = "JOB"
+		report.Title = "Job " + id
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	if err := pages.ExecuteTemplate(w, page, report); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal error: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func webcanceljob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/cancel/")
+	if err := remotecommand("jobs", "-cancel", id).Run(); err != nil {
+		log.Println(err)
+	}
+
+	http.Redirect(w, r, "/jobs/", http.StatusFound)
+}
+
 func webvacuum(w http.ResponseWriter, r *http.Request) {
 	args := []string{"vacuum"}
 	cmd := remotecommand(args...)
@@ -484,6 +683,7 @@ func web() {
 	Setup()
 
 	verbose = false // disable verbose mode when using web ui
+	inprocess = false // handlers run concurrently: commands on a local vault need their own process
 	if root == "" {
 		root = cfg.WebRoot
 	}
@@ -520,10 +720,14 @@ func web() {
 	if cfg.IsServer() {
 		http.HandleFunc("/tools/", webtools)
 		http.HandleFunc("/tools/vacuum", webvacuum)
+		http.HandleFunc("/jobs/", webjobs)
+		http.HandleFunc("/jobs/cancel/", webcanceljob)
 	}
 	http.HandleFunc("/", webhome)
 	http.HandleFunc("/about/", webhome)
 	http.HandleFunc("/delete/", webdelete)
+	http.HandleFunc("/analysis/", webanalysis)
+	http.HandleFunc("/diff/", webdiff)
 	http.HandleFunc("/new/", webnew)
 	http.HandleFunc("/start/", webstart)
 	http.HandleFunc("/dryrun/", webdryrun)
@@ -532,6 +736,7 @@ func web() {
 	Info(false)
 	Failure(false)
 	timeout = 10
+	UseSession() // keep a single connection to the server for all requests
 
 	if listen == "" {
 		if cfg.Web != "" {
@@ -542,7 +747,11 @@ func web() {
 	}
 
 	Daemonize()
-	if err := http.ListenAndServe(listen, nil); err != nil {
+	if err := serveapi(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		log.Printf("Could not start HTTP transport: msg=%q error=warn\n", err)
+	}
+	if err := listenandserve(listen); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		if os.Getenv("PUKCAB_WEB") == "" {
 			log.Fatal("Could no start web interface: ", err)